@@ -18,8 +18,10 @@ limitations under the License.
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -38,31 +40,11 @@ Cobra is a CLI library for Go that empowers applications.
 This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		var snifferCfg sniff.ProxyCfg
-		err := viper.Unmarshal(&snifferCfg)
-		if err != nil {
-			return err
-		}
-		sniffer := sniff.New(snifferCfg.Cfg)
-		sniffingCtx, cancelSniffing := context.WithCancel(context.Background())
-		defer cancelSniffing()
-
-		// add logging handler
-		err = sniffer.AddHandler(
-			func(ctx context.Context, req *http.Request) error {
-				log.Printf("%s-> %s%s", req.RemoteAddr, req.Host, req.RequestURI)
-				return nil
-			},
-		)
-		if err != nil {
-			return errors.Wrap(err, "failed to add handler")
-		}
-
-		if err := sniffer.Run(sniffingCtx); err != nil {
-			return err
-		}
+		return runLog(cmd.Context(), func(ctx context.Context, req *http.Request) error {
+			log.Printf("%s-> %s%s", req.RemoteAddr, req.Host, req.RequestURI)
 
-		return nil
+			return nil
+		})
 	},
 }
 
@@ -78,33 +60,102 @@ Cobra is a CLI library for Go that empowers applications.
 This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		var snifferCfg sniff.ProxyCfg
-		err := viper.Unmarshal(&snifferCfg)
-		if err != nil {
-			return errors.Wrap(err, "failed to unmarshal config")
-		}
-		sniffer := sniff.New(snifferCfg.Cfg)
-		sniffingCtx, cancelSniffing := context.WithCancel(context.Background())
-		defer cancelSniffing()
+		return runLog(cmd.Context(), func(ctx context.Context, req *http.Request) error {
+			log.Printf("%s %s", req.RemoteAddr, req.RequestURI)
 
-		// add logging handler
-		err = sniffer.AddHandler(
-			func(ctx context.Context, req *http.Request) error {
-				log.Printf("%s %s", req.RemoteAddr, req.RequestURI)
+			return nil
+		})
+	},
+}
 
-				return nil
-			},
+// runLog runs the sniffer of the log commands, which logs the http requests with logRequest and the mqtt
+// packets with logMQTTEvent.
+func runLog(ctx context.Context, logRequest sniff.Handler) error {
+	var snifferCfg sniff.ProxyCfg
+	err := viper.Unmarshal(&snifferCfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to unmarshal config")
+	}
+
+	handlerOpts, err := handlerOptions(&snifferCfg, "log")
+	if err != nil {
+		return err
+	}
+
+	mqttHandlerOpts, err := handlerOptions(&snifferCfg, "log-mqtt")
+	if err != nil {
+		return err
+	}
+
+	middlewares, sampler, err := requestMiddlewares("log", snifferCfg.Sampling, snifferCfg.HTTPFilter)
+	if err != nil {
+		return err
+	}
+
+	sniffer := sniff.New(snifferCfg.Cfg)
+
+	// add logging handler
+	err = sniffer.AddHandler(sniff.Chain(logRequest, middlewares...), handlerOpts...)
+	if err != nil {
+		return errors.Wrap(err, "failed to add handler")
+	}
+
+	// http events never reach the queue of the mqtt handler, where they would wait or spill only to be dropped
+	mqttHandlerOpts = append(mqttHandlerOpts, sniff.WithEventFilter(func(event sniff.Event) bool {
+		_, ok := event.(*sniff.MQTTEvent)
+
+		return ok
+	}))
+
+	err = sniffer.AddEventHandler(logMQTTEvent, mqttHandlerOpts...)
+	if err != nil {
+		return errors.Wrap(err, "failed to add handler")
+	}
+
+	cmdCounters := counters{samplers: []*sniff.Sampler{sampler}}
+	if err := runSniffer(ctx, sniffer, &snifferCfg, cmdCounters); err != nil {
+		return errors.Wrap(err, "failed to run sniffer")
+	}
+
+	return nil
+}
+
+// logMQTTEvent logs decoded mqtt packets. http requests are logged by the request handlers of the
+// commands.
+func logMQTTEvent(ctx context.Context, event sniff.Event) error {
+	mqttEvent, ok := event.(*sniff.MQTTEvent)
+	if !ok {
+		return nil
+	}
+
+	packet := mqttEvent.Packet
+
+	switch packet.Type {
+	case sniff.MQTTConnect:
+		log.Printf(
+			"%s mqtt %s client_id=%q username=%q keepalive=%d", mqttEvent.Flow, packet.Type,
+			packet.ClientID, packet.Username, packet.KeepAlive,
+		)
+	case sniff.MQTTPublish:
+		log.Printf(
+			"%s mqtt %s topic=%q qos=%d retain=%t payload=%d bytes", mqttEvent.Flow, packet.Type,
+			packet.Topic, packet.QoS, packet.Retain, len(packet.Payload),
 		)
-		if err != nil {
-			return errors.Wrap(err, "failed to add handler")
+	case sniff.MQTTSubscribe, sniff.MQTTUnsubscribe:
+		topics := make([]string, 0, len(packet.Subscriptions))
+		for _, subscription := range packet.Subscriptions {
+			topics = append(topics, fmt.Sprintf("%s(qos %d)", subscription.Topic, subscription.QoS))
 		}
 
-		if err := sniffer.Run(sniffingCtx); err != nil {
-			return errors.Wrap(err, "failed to run sniffer")
-		}
+		log.Printf("%s mqtt %s %s", mqttEvent.Flow, packet.Type, strings.Join(topics, ","))
+	default:
+		log.Printf(
+			"%s mqtt %s packet_id=%d reason_codes=%v", mqttEvent.Flow, packet.Type, packet.PacketID,
+			packet.ReasonCodes,
+		)
+	}
 
-		return nil
-	},
+	return nil
 }
 
 func init() {
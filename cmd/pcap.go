@@ -44,4 +44,31 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+
+	pcapCmd.PersistentFlags().Float64(
+		"replay-speed", 0, "replay packets at their capture timing times speed, e.g. 0.5, 2 or 10, 0 is unpaced",
+	)
+	err = viper.BindPFlag("CFG.REPLAY.SPEED", pcapCmd.PersistentFlags().Lookup("replay-speed"))
+	if err != nil {
+		panic(err)
+	}
+
+	pcapCmd.PersistentFlags().Float64(
+		"replay-rps", 0, "replay requests at a fixed rate per second instead of their capture timing",
+	)
+	err = viper.BindPFlag("CFG.REPLAY.REQUESTS_PER_SECOND", pcapCmd.PersistentFlags().Lookup("replay-rps"))
+	if err != nil {
+		panic(err)
+	}
+
+	// only the proxy sends requests, so the limit is a flag of the proxy command
+	pcapProxyCmd.PersistentFlags().Int(
+		"replay-max-concurrency", 0, "requests proxied at the same time across targets, 0 is unlimited",
+	)
+	err = viper.BindPFlag(
+		"CFG.REPLAY.MAX_CONCURRENCY", pcapProxyCmd.PersistentFlags().Lookup("replay-max-concurrency"),
+	)
+	if err != nil {
+		panic(err)
+	}
 }
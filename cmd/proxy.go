@@ -17,18 +17,14 @@ limitations under the License.
 */
 
 import (
-	"bytes"
 	"context"
-	"io"
-	"io/ioutil"
 	"log"
-	"net"
-	"net/http"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/strixeyecom/gniffer/pkg/shadow"
 	"github.com/strixeyecom/gniffer/pkg/sniff"
 )
 
@@ -36,141 +32,160 @@ const clientTimeout = 20
 const MaxWorkers = 1e3 * 2
 const MaxIdleConnectionsPerHost = MaxWorkers
 
-// nolint: gochecknoglobals // because we want all workers to share the same client and using a struct is
-// overkill.
-var client = &http.Client{
-	Transport: &http.Transport{
-		MaxIdleConnsPerHost: MaxIdleConnectionsPerHost,
-	},
-	Timeout: time.Second * clientTimeout,
+// proxyCmd represents the proxy command.
+var proxyCmd = &cobra.Command{
+	Use:   "proxy",
+	Short: "copy and redirect sniffed requests",
+	Long: `proxy command copies the sniffed request and sends to given target server,
+without changing the host headers`,
+	RunE: runProxyCmd,
 }
 
-func worker(ctx context.Context, c chan *http.Request) {
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case req := <-c:
-			resp, err := client.Do(req)
-			if err != nil {
-				panic(err)
-			}
+// pcapProxyCmd represents the proxy command of pcap files.
+// nolint:gochecknoglobals // because cobra thinks this is the correct wawy
+var pcapProxyCmd = &cobra.Command{
+	Use:   "proxy",
+	Short: "copy and redirect requests read from a pcap file",
+	Long: `proxy command copies the requests read from a pcap file and sends to given target server,
+without changing the host headers. Requests are sent as fast as the file is read, or paced by the
+replay flags`,
+	RunE: runProxyCmd,
+}
 
-			_, _ = io.Copy(ioutil.Discard, resp.Body)
+func runProxyCmd(cmd *cobra.Command, args []string) error {
+	var proxyCfg sniff.ProxyCfg
+	err := viper.Unmarshal(&proxyCfg)
+	if err != nil {
+		return err
+	}
 
-			err = resp.Body.Close()
-			if err != nil {
-				panic(err)
-			}
-		}
+	err = RunProxy(cmd.Context(), &proxyCfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to add handler")
 	}
+
+	return nil
 }
 
-// proxyCmd represents the proxy command.
-var proxyCmd = &cobra.Command{
-	Use:   "proxy",
-	Short: "copy and redirect sniffed requests",
-	Long: `proxy command copies the sniffed request and sends to given target server,
-without changing the host headers`,
-	RunE: func(cmd *cobra.Command, args []string) error {
-		var proxyCfg sniff.ProxyCfg
-		err := viper.Unmarshal(&proxyCfg)
+func RunProxy(ctx context.Context, proxyCfg *sniff.ProxyCfg) error {
+	targetCfgs, err := proxyCfg.ProxyTargets()
+	if err != nil {
+		return err
+	}
+
+	sniffer := sniff.New(proxyCfg.Cfg)
+
+	// workers finish the requests in flight when the proxy is shutting down, until the shutdown timeout
+	workerCtx, cancelWorkers := drainContext(ctx, proxyCfg.ShutdownTimeout)
+	defer cancelWorkers()
+
+	targets := make([]*target, 0, len(targetCfgs))
+	cmdCounters := counters{samplers: make([]*sniff.Sampler, 0, len(targetCfgs))}
+
+	var slots chan struct{}
+	if proxyCfg.Cfg.Replay.MaxConcurrency > 0 {
+		slots = make(chan struct{}, proxyCfg.Cfg.Replay.MaxConcurrency)
+	}
+
+	source := proxyCfg.Cfg.InterfaceName
+	if !proxyCfg.Cfg.IsLive {
+		source = proxyCfg.Cfg.PcapPath
+	}
+
+	// every target is a handler of its own, so that a slow target does not hold back the others
+	for _, targetCfg := range targetCfgs {
+		t, err := newTarget(proxyCfg, targetCfg)
+		if err != nil {
+			return err
+		}
+
+		t.slots = slots
+
+		handlerOpts, err := handlerOptions(proxyCfg, t.handlerName())
 		if err != nil {
 			return err
 		}
 
-		sniffingCtx, cancelSniffing := context.WithCancel(context.Background())
-		defer cancelSniffing()
-		err = RunProxy(sniffingCtx, &proxyCfg)
+		if t.preservesConnections() {
+			// the requests of a connection are handed to its upstream in the order they are captured, by
+			// several workers so that a connection whose upstream is full does not hold back all the others
+			handlerOpts = append(
+				handlerOpts, sniff.WithOrdering(sniff.OrderPerConnection), sniff.WithConcurrency(t.upstreamHandlers()),
+			)
+		}
+
+		err = sniffer.AddHandler(t.handler(workerCtx), handlerOpts...)
 		if err != nil {
 			return errors.Wrap(err, "failed to add handler")
 		}
 
-		return nil
-	},
-}
+		t.start(workerCtx, sniffer.ReportError)
 
-func RunProxy(ctx context.Context, proxyCfg *sniff.ProxyCfg) error {
-	if proxyCfg.TargetPort == "" {
-		return errors.New("target port is required")
-	}
+		targets = append(targets, t)
+		cmdCounters.samplers = append(cmdCounters.samplers, t.sampler)
+		cmdCounters.deliveries = append(cmdCounters.deliveries, t.delivery)
 
-	sniffer := sniff.New(proxyCfg.Cfg)
+		if t.queue != nil {
+			cmdCounters.queues = append(cmdCounters.queues, t.queue)
+		}
+
+		if t.comparer != nil {
+			cmdCounters.comparers = append(cmdCounters.comparers, t.comparer)
+		}
 
-	requestChan := make(chan *http.Request)
-	for i := 0; i < MaxWorkers; i++ {
-		go worker(ctx, requestChan)
+		log.Printf("proxying %s requests to %s as %s", source, t.baseURL(), t.cfg.Name)
 	}
-	// add logging handler
-	err := sniffer.AddHandler(
-		func(ctx context.Context, req *http.Request) error {
-			return handlerFunc(ctx, req, proxyCfg, requestChan)
-		},
-	)
-	if err != nil {
-		return errors.Wrap(err, "failed to add handler")
+
+	if len(cmdCounters.comparers) > 0 {
+		// comparisons are best effort like metrics, they should never hold back the sniffer
+		err = sniffer.AddEventHandler(
+			compareProduction(cmdCounters.comparers), sniff.WithName("shadow"),
+			sniff.WithOverflowPolicy(sniff.OverflowDropNewest), sniff.WithErrorPolicy(sniff.ErrorIgnore),
+		)
+		if err != nil {
+			return errors.Wrap(err, "failed to add shadow handler")
+		}
 	}
 
-	log.Printf(
-		"proxying %s %s requests to %s://%s:%s", proxyCfg.Cfg.InterfaceName,
-		proxyCfg.HTTPFilter.Hostname, proxyCfg.TargetProtocol,
-		proxyCfg.TargetHost, proxyCfg.TargetPort,
-	)
+	err = runSniffer(ctx, sniffer, proxyCfg, cmdCounters)
+
+	// the handlers are stopped, no more requests will be queued
+	for _, t := range targets {
+		t.stop()
+	}
 
-	if err := sniffer.Run(ctx); err != nil {
+	if err != nil {
 		return errors.Wrap(err, "can not run sniffer")
 	}
 
 	return nil
 }
 
-func handlerFunc(
-	ctx context.Context, req *http.Request, proxyCfg *sniff.ProxyCfg, requestChan chan *http.Request,
-) error {
-	if proxyCfg.HTTPFilter != nil {
-		if !proxyCfg.HTTPFilter.Match(req) {
+// compareProduction returns the event handler that passes the responses the sniffer captures to the
+// comparers, which keep the ones of the requests they mirror.
+func compareProduction(comparers []*shadow.Comparer) sniff.EventHandler {
+	return func(_ context.Context, event sniff.Event) error {
+		respEvent, ok := event.(*sniff.HTTPResponseEvent)
+		if !ok || respEvent.Request == nil {
 			return nil
 		}
-	}
-
-	dupReq := req.Clone(ctx)
-	// modify request so that it goes to the target server but still has the original headers
-	dupReq.URL.Scheme = proxyCfg.TargetProtocol
-	dupReq.URL.Host = proxyCfg.TargetHost + ":" + proxyCfg.TargetPort
-	// request uri is handled by the client library
-	dupReq.RequestURI = ""
 
-	// add original client information to x- headers while proxying
-	ip, port, err := net.SplitHostPort(req.RemoteAddr)
-	if proxyCfg.AppendXFF {
+		body, err := sniff.ResponseBody(respEvent.Response)
 		if err != nil {
-			return err
+			return errors.Wrap(err, "failed to read production response")
 		}
 
-		dupReq.Header.Add("X-Forwarded-For", ip)
-		dupReq.Header.Set("X-Forwarded-Port", port)
-	}
+		for _, comparer := range comparers {
+			comparer.Production(respEvent.Request, comparer.NewResponse(respEvent.Response, body))
+		}
 
-	if proxyCfg.EnableOriginHeaders {
-		dupReq.Header.Set("Gniffer-Connecting-Ip", ip)
-		dupReq.Header.Set("Gniffer-Connecting-Port", port)
-	}
-	// should copy the body because the original request body will be emptied
-	body, err := ioutil.ReadAll(req.Body)
-	if err == nil {
-		dupReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return nil
 	}
-
-	req.Header.Set("Connection", "close")
-	req.Close = true
-	requestChan <- dupReq
-
-	return nil
 }
 
 func init() {
 	sniffCmd.AddCommand(proxyCmd)
+	pcapCmd.AddCommand(pcapProxyCmd)
 
 	// Cobra supports Persistent Flags which will work for this command
 	// and all subcommands, e.g.:
@@ -209,4 +224,194 @@ func init() {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	proxyCmd.PersistentFlags().String(
+		"target-http-version", "1.1", "http version of requests sent to the target: 1.1, 2 (https) or h2c (http)",
+	)
+
+	err = viper.BindPFlag("TARGET_HTTP_VERSION", proxyCmd.PersistentFlags().Lookup("target-http-version"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().Bool(
+		"preserve-connections", false,
+		"send the requests of every client connection over a connection of their own, in captured order",
+	)
+
+	err = viper.BindPFlag("PRESERVE_CONNECTIONS", proxyCmd.PersistentFlags().Lookup("preserve-connections"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().Float64(
+		"amplify-factor", 1, "times every request is sent to the targets, e.g. 3 or 1.5, for load tests",
+	)
+
+	err = viper.BindPFlag("AMPLIFY.FACTOR", proxyCmd.PersistentFlags().Lookup("amplify-factor"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().Duration(
+		"amplify-spread", 0, "delay every copy of a request by a random time up to spread",
+	)
+
+	err = viper.BindPFlag("AMPLIFY.SPREAD", proxyCmd.PersistentFlags().Lookup("amplify-spread"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().Int("target-attempts", 1, "times a request is sent to a target before giving up")
+
+	err = viper.BindPFlag("RETRY.ATTEMPTS", proxyCmd.PersistentFlags().Lookup("target-attempts"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().Duration(
+		"target-retry-backoff", time.Millisecond*100,
+		"wait before the first retry to a target, doubled for every retry and jittered",
+	)
+
+	err = viper.BindPFlag("RETRY.BACKOFF", proxyCmd.PersistentFlags().Lookup("target-retry-backoff"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().IntSlice(
+		"target-retry-statuses", nil, "response statuses retried besides transport errors, e.g. 502,503,504",
+	)
+
+	err = viper.BindPFlag("RETRY.STATUS_CODES", proxyCmd.PersistentFlags().Lookup("target-retry-statuses"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().Int(
+		"target-breaker-failures", 0, "consecutive failures that stop sending to a target, 0 disables it",
+	)
+
+	err = viper.BindPFlag(
+		"CIRCUIT_BREAKER.FAILURES", proxyCmd.PersistentFlags().Lookup("target-breaker-failures"),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().Duration(
+		"target-breaker-cool-down", time.Second*30,
+		"how long a tripped circuit breaker waits before probing a target",
+	)
+
+	err = viper.BindPFlag(
+		"CIRCUIT_BREAKER.COOL_DOWN", proxyCmd.PersistentFlags().Lookup("target-breaker-cool-down"),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().String(
+		"target-queue-dir", "",
+		"directory of the durable queues that keep requests to targets on disk (default disabled)",
+	)
+
+	err = viper.BindPFlag("DISK_QUEUE.DIR", proxyCmd.PersistentFlags().Lookup("target-queue-dir"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().Int64(
+		"target-queue-max-size", 1<<30,
+		"bytes a target's disk queue may use before its oldest requests are dropped",
+	)
+
+	err = viper.BindPFlag("DISK_QUEUE.MAX_SIZE", proxyCmd.PersistentFlags().Lookup("target-queue-max-size"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().Duration(
+		"target-queue-max-age", 0, "drop requests queued on disk for longer than this, 0 keeps them",
+	)
+
+	err = viper.BindPFlag("DISK_QUEUE.MAX_AGE", proxyCmd.PersistentFlags().Lookup("target-queue-max-age"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().Float64(
+		"target-queue-drain-rate", 0, "requests per second taken from a target's disk queue, 0 is unlimited",
+	)
+
+	err = viper.BindPFlag("DISK_QUEUE.DRAIN_RATE", proxyCmd.PersistentFlags().Lookup("target-queue-drain-rate"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().Bool(
+		"strip-credentials", false, "drop the Authorization header and other credentials of mirrored requests",
+	)
+
+	err = viper.BindPFlag("CREDENTIALS.ENABLED", proxyCmd.PersistentFlags().Lookup("strip-credentials"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().String(
+		"target-ca-file", "", "pem bundle of the certificate authorities https targets are verified with",
+	)
+
+	err = viper.BindPFlag("TLS.CA_FILE", proxyCmd.PersistentFlags().Lookup("target-ca-file"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().String("target-cert-file", "", "pem client certificate sent to https targets")
+
+	err = viper.BindPFlag("TLS.CERT_FILE", proxyCmd.PersistentFlags().Lookup("target-cert-file"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().String(
+		"target-key-file", "", "pem key of the client certificate sent to https targets",
+	)
+
+	err = viper.BindPFlag("TLS.KEY_FILE", proxyCmd.PersistentFlags().Lookup("target-key-file"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().String(
+		"target-server-name", "", "server name sent to and verified with https targets, instead of the target host",
+	)
+
+	err = viper.BindPFlag("TLS.SERVER_NAME", proxyCmd.PersistentFlags().Lookup("target-server-name"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().String(
+		"target-tls-min-version", "", "lowest tls version used with https targets: 1.0, 1.1, 1.2 or 1.3",
+	)
+
+	err = viper.BindPFlag("TLS.MIN_VERSION", proxyCmd.PersistentFlags().Lookup("target-tls-min-version"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxyCmd.PersistentFlags().Bool(
+		"target-insecure-skip-verify", false, "accept any certificate of https targets, for tests only",
+	)
+
+	err = viper.BindPFlag(
+		"TLS.INSECURE_SKIP_VERIFY", proxyCmd.PersistentFlags().Lookup("target-insecure-skip-verify"),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// both proxy commands share the flags, which are bound to the config only once
+	pcapProxyCmd.PersistentFlags().AddFlagSet(proxyCmd.PersistentFlags())
 }
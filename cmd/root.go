@@ -17,12 +17,21 @@ limitations under the License.
 */
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"net"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/strixeyecom/gniffer/pkg/metrics"
+	"github.com/strixeyecom/gniffer/pkg/shadow"
+	"github.com/strixeyecom/gniffer/pkg/sniff"
 )
 
 var cfgFile string
@@ -42,7 +51,10 @@ log, proxy or process sniffed requests.
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	cobra.CheckErr(rootCmd.Execute())
+	ctx, stop := signalContext()
+	defer stop()
+
+	cobra.CheckErr(rootCmd.ExecuteContext(ctx))
 }
 
 func init() {
@@ -66,6 +78,115 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+
+	rootCmd.PersistentFlags().IntSlice(
+		"mqtt-ports", []int{1883}, "tcp ports whose traffic is decoded as mqtt instead of http",
+	)
+	err = viper.BindPFlag("CFG.MQTT_PORTS", rootCmd.PersistentFlags().Lookup("mqtt-ports"))
+	if err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().String(
+		"http-filter", "",
+		`filter expression for sniffed requests, e.g. 'method == "POST" && path.glob("/api/v2/*")'`,
+	)
+	err = viper.BindPFlag("HTTP_FILTER.EXPRESSION", rootCmd.PersistentFlags().Lookup("http-filter"))
+	if err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().Float64("sample-percent", 100, "percentage of the filtered requests to handle")
+	err = viper.BindPFlag("SAMPLING.PERCENT", rootCmd.PersistentFlags().Lookup("sample-percent"))
+	if err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().String(
+		"sample-key", "",
+		"keep or drop requests of the same client together by client_ip, header:<name>, cookie:<name> or "+
+			"claim:<name> of the bearer token",
+	)
+	err = viper.BindPFlag("SAMPLING.KEY", rootCmd.PersistentFlags().Lookup("sample-key"))
+	if err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().Float64(
+		"sample-max-per-second", 0, "maximum handled requests per second of every host and route, 0 disables it",
+	)
+	err = viper.BindPFlag("SAMPLING.MAX_PER_SECOND", rootCmd.PersistentFlags().Lookup("sample-max-per-second"))
+	if err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().Int("queue-size", 1024, "number of sniffed requests buffered for each handler")
+	err = viper.BindPFlag("QUEUE.SIZE", rootCmd.PersistentFlags().Lookup("queue-size"))
+	if err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().String(
+		"overflow-policy", "block",
+		"what to do when a handler queue is full: block, drop-newest, drop-oldest or spill",
+	)
+	err = viper.BindPFlag("QUEUE.OVERFLOW_POLICY", rootCmd.PersistentFlags().Lookup("overflow-policy"))
+	if err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().String("spill-dir", "", "directory for the spill overflow policy (default is os temp dir)")
+	err = viper.BindPFlag("QUEUE.SPILL_DIR", rootCmd.PersistentFlags().Lookup("spill-dir"))
+	if err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().String(
+		"handler-error-policy", "stop", "what to do when a handler fails: stop, ignore, log or retry",
+	)
+	err = viper.BindPFlag("ERRORS.POLICY", rootCmd.PersistentFlags().Lookup("handler-error-policy"))
+	if err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().Int("handler-retries", 3, "number of retries for the retry error policy")
+	err = viper.BindPFlag("ERRORS.RETRIES", rootCmd.PersistentFlags().Lookup("handler-retries"))
+	if err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().Duration(
+		"handler-retry-backoff", time.Millisecond*100, "wait before the first retry, doubled for every retry",
+	)
+	err = viper.BindPFlag("ERRORS.RETRY_BACKOFF", rootCmd.PersistentFlags().Lookup("handler-retry-backoff"))
+	if err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().Duration(
+		"stats-interval", time.Second*30, "how often to log sniffer and handler counters, 0 disables them",
+	)
+	err = viper.BindPFlag("STATS_INTERVAL", rootCmd.PersistentFlags().Lookup("stats-interval"))
+	if err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().String(
+		"metrics-listen", "", "address to serve prometheus metrics on at /metrics, e.g. :9090 (default disabled)",
+	)
+	err = viper.BindPFlag("METRICS_LISTEN", rootCmd.PersistentFlags().Lookup("metrics-listen"))
+	if err != nil {
+		panic(err)
+	}
+
+	rootCmd.PersistentFlags().Duration(
+		"shutdown-timeout", time.Second*30,
+		"how long to wait for queued requests to be handled after SIGINT or SIGTERM",
+	)
+	err = viper.BindPFlag("SHUTDOWN_TIMEOUT", rootCmd.PersistentFlags().Lookup("shutdown-timeout"))
+	if err != nil {
+		panic(err)
+	}
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -90,3 +211,218 @@ func initConfig() {
 		_, _ = fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 	}
 }
+
+// handlerOptions returns the queue and error handling options of the command's handlers.
+func handlerOptions(cfg *sniff.ProxyCfg, name string) ([]sniff.HandlerOption, error) {
+	queueOpts, err := cfg.Queue.HandlerOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	errorOpts, err := cfg.Errors.HandlerOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := append(queueOpts, errorOpts...)
+
+	return append(opts, sniff.WithName(name)), nil
+}
+
+// requestMiddlewares returns the middlewares that pass only the requests matching every http filter, and
+// then only the ones sampled as configured by sampling. The sampler reports its counters with name.
+func requestMiddlewares(
+	name string, sampling sniff.SamplingCfg, filters ...*sniff.HTTPFilter,
+) ([]sniff.Middleware, *sniff.Sampler, error) {
+	var middlewares []sniff.Middleware
+
+	for _, filter := range filters {
+		if filter == nil {
+			continue
+		}
+
+		match, err := filter.Matcher()
+		if err != nil {
+			return nil, nil, errors.WithMessagef(err, "%s", name)
+		}
+
+		middlewares = append(middlewares, sniff.Filter(match))
+	}
+
+	sampler, err := sniff.NewSampler(name, sampling)
+	if err != nil {
+		return nil, nil, errors.WithMessagef(err, "%s", name)
+	}
+
+	return append(middlewares, sampler.Middleware()), sampler, nil
+}
+
+// counters are the samplers, deliveries, disk queues and comparers of a command, whose counters are
+// reported along with the ones of the sniffer.
+type counters struct {
+	samplers   []*sniff.Sampler
+	deliveries []*sniff.Delivery
+	queues     []*sniff.RequestQueue
+	comparers  []*shadow.Comparer
+}
+
+// runSniffer runs the sniffer, serving its metrics and logging its counters as configured until it stops.
+// The counters of the command are reported along with the ones of the sniffer. When ctx
+// is done, the sniffer stops capturing and gets ShutdownTimeout to handle what it already captured. The
+// final counters are logged when it stops.
+func runSniffer(
+	ctx context.Context, sniffer sniff.Sniffer, cfg *sniff.ProxyCfg, cmdCounters counters,
+) error {
+	if cfg.MetricsListen != "" {
+		stopMetrics, err := serveMetrics(sniffer, cfg.MetricsListen, cmdCounters)
+		if err != nil {
+			return err
+		}
+
+		defer stopMetrics()
+	}
+
+	if cfg.StatsInterval > 0 {
+		statsCtx, cancelStats := context.WithCancel(ctx)
+		defer cancelStats()
+
+		go logStatsEvery(statsCtx, sniffer, cmdCounters, cfg.StatsInterval)
+	}
+
+	drainCtx, cancelDrain := drainContext(ctx, cfg.ShutdownTimeout)
+	defer cancelDrain()
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+
+	go func() {
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			if err := sniffer.Shutdown(drainCtx); err != nil {
+				log.Printf("shutdown timeout exceeded, queued requests are dropped: %s", err)
+			}
+		}
+	}()
+
+	err := sniffer.Run(context.Background())
+
+	logStats(sniffer.Stats(), cmdCounters)
+
+	return err
+}
+
+// serveMetrics serves the counters of the sniffer and the red metrics of the captured http traffic on
+// /metrics. The returned function stops the server.
+func serveMetrics(sniffer sniff.Sniffer, addr string, cmdCounters counters) (func(), error) {
+	registry := metrics.NewRegistry()
+	metrics.RegisterSniffer(registry, sniffer)
+	metrics.RegisterSamplers(registry, cmdCounters.samplers...)
+	metrics.RegisterDeliveries(registry, cmdCounters.deliveries...)
+	metrics.RegisterRequestQueues(registry, cmdCounters.queues...)
+	metrics.RegisterComparers(registry, cmdCounters.comparers...)
+
+	traffic := metrics.NewTraffic(registry, metrics.DefaultMaxSeries)
+
+	// metrics are best effort, they should never hold back the sniffer
+	err := sniffer.AddEventHandler(
+		traffic.Handle, sniff.WithName("metrics"), sniff.WithOverflowPolicy(sniff.OverflowDropNewest),
+		sniff.WithErrorPolicy(sniff.ErrorIgnore),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to add metrics handler")
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen on %s for metrics", addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: time.Second * 10}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("metrics server failed: %s", err)
+		}
+	}()
+
+	log.Printf("serving metrics on http://%s/metrics", listener.Addr())
+
+	return func() {
+		_ = server.Close()
+	}, nil
+}
+
+// logStatsEvery logs the counters of the sniffer and the command every interval until ctx is done.
+func logStatsEvery(
+	ctx context.Context, sniffer sniff.Sniffer, cmdCounters counters, interval time.Duration,
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			logStats(sniffer.Stats(), cmdCounters)
+		}
+	}
+}
+
+func logStats(stats sniff.Stats, cmdCounters counters) {
+	log.Printf(
+		"stats: received=%d dropped=%d if_dropped=%d decoded=%d non_tcp=%d invalid=%d streams=%d "+
+			"flushed=%d http_errors=%d mqtt_errors=%d requests=%d responses=%d events=%d errors=%d panics=%d",
+		stats.Capture.Received, stats.Capture.Dropped, stats.Capture.InterfaceDropped, stats.PacketsDecoded,
+		stats.PacketsNonTCP, stats.PacketsInvalid, stats.ActiveStreams, stats.FlushedStreams,
+		stats.HTTPParseErrors, stats.MQTTParseErrors, stats.RequestsEmitted, stats.ResponsesEmitted,
+		stats.EventsEmitted, stats.Errors, stats.Panics,
+	)
+
+	for _, handler := range stats.Handlers {
+		log.Printf(
+			"stats: handler %s handled=%d queued=%d spill_queued=%d dropped=%d errors=%d retries=%d "+
+				"avg_latency=%s max_latency=%s",
+			handler.Name, handler.Handled, handler.Queued, handler.SpillQueued, handler.Dropped, handler.Errors,
+			handler.Retries, handler.AvgLatency, handler.MaxLatency,
+		)
+	}
+
+	for _, sampler := range cmdCounters.samplers {
+		sampling := sampler.Stats()
+		log.Printf(
+			"stats: sampler %s sampled=%d unsampled=%d rate_limited=%d", sampling.Name, sampling.Sampled,
+			sampling.Unsampled, sampling.RateLimited,
+		)
+	}
+
+	for _, delivery := range cmdCounters.deliveries {
+		targetStats := delivery.Stats()
+		log.Printf(
+			"stats: target %s attempts=%d retries=%d failed=%d short_circuited=%d breaker=%s breaker_opens=%d",
+			targetStats.Name, targetStats.Attempts, targetStats.Retries, targetStats.Failed,
+			targetStats.ShortCircuited, targetStats.BreakerState, targetStats.BreakerOpens,
+		)
+	}
+
+	for _, queue := range cmdCounters.queues {
+		queueStats := queue.Stats()
+		log.Printf(
+			"stats: disk queue %s queued=%d size=%d expired=%d trimmed=%d", queueStats.Name, queueStats.Queued,
+			queueStats.Size, queueStats.Expired, queueStats.Trimmed,
+		)
+	}
+
+	for _, comparer := range cmdCounters.comparers {
+		comparison := comparer.Stats()
+		log.Printf(
+			"stats: shadow %s compared=%d mismatched=%d unpaired=%d status=%d header=%d body=%d",
+			comparison.Name, comparison.Compared, comparison.Mismatched, comparison.Unpaired,
+			comparison.StatusMismatches, comparison.HeaderMismatches, comparison.BodyMismatches,
+		)
+	}
+}
@@ -0,0 +1,79 @@
+package cmd
+
+/*
+Copyright © 2021 strixeye keser@strixeye.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// signalContext returns a context that is done on the first SIGINT or SIGTERM, which asks the command to
+// shut down gracefully. The second signal exits right away.
+func signalContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("received %s, shutting down. send it again to exit immediately", sig)
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+
+		sig := <-signals
+		log.Printf("received %s again, exiting", sig)
+		os.Exit(1)
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// drainContext returns a context that is done timeout after ctx is done, which is the deadline for
+// finishing the work that is already started when the command is asked to shut down.
+func drainContext(ctx context.Context, timeout time.Duration) (context.Context, func()) {
+	drainCtx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-drainCtx.Done():
+			return
+		}
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			cancel()
+		case <-drainCtx.Done():
+		}
+	}()
+
+	return drainCtx, cancel
+}
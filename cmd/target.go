@@ -0,0 +1,815 @@
+package cmd
+
+/*
+Copyright © 2021 strixeye keser@strixeye.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/strixeyecom/gniffer/pkg/shadow"
+	"github.com/strixeyecom/gniffer/pkg/sniff"
+)
+
+// target is a destination the proxy mirrors requests to, with its own filter, sampling, client and
+// workers.
+type target struct {
+	cfg      sniff.TargetCfg
+	proxyCfg *sniff.ProxyCfg
+
+	middlewares []sniff.Middleware
+	sampler     *sniff.Sampler
+	rewriter    *sniff.Rewriter
+	credentials *sniff.Credentials
+	client      *http.Client
+	delivery    *sniff.Delivery
+
+	// comparer compares the responses of the target with the production responses, and report is the file
+	// it reports mismatches to. They are nil unless the target compares its responses.
+	comparer *shadow.Comparer
+	report   *os.File
+
+	// queue keeps the requests of the target on disk until the feeder hands them to the workers. It is nil
+	// unless the target has a disk queue, then requests go to the workers directly.
+	queue       *sniff.RequestQueue
+	stopFeeding chan struct{}
+	feeder      sync.WaitGroup
+
+	// upstreams are the upstreams of the captured client connections, if the target preserves connections.
+	// Requests that are not captured by the sniffer still go to the workers.
+	upstreams       map[string]*upstream
+	upstreamsMu     sync.Mutex
+	upstreamWorkers sync.WaitGroup
+	tlsConfig       *tls.Config
+	// reportError is passed the requests that fail, it is set by start.
+	reportError func(event *sniff.ErrorEvent)
+	// slots limits the requests sent at the same time, it is shared by every target of the proxy. It is
+	// nil if they are not limited.
+	slots chan struct{}
+
+	// amplifier makes the copies of the requests of the target, it is nil unless requests are amplified.
+	// amplifying tracks the copies waiting for their delay, until stopAmplifying is closed.
+	amplifier      *sniff.Amplifier
+	amplifying     sync.WaitGroup
+	stopAmplifying chan struct{}
+	// copyLanes order the delayed copies sent to the same upstream, by upstream key.
+	copyLanes   map[string]*copyLane
+	copyLanesMu sync.Mutex
+
+	requests chan mirrorRequest
+	workers  sync.WaitGroup
+}
+
+// copyLane orders the delayed copies of a client connection with the same index, which share an upstream.
+// due is when the last copy of the lane is due, and last is closed once it is dispatched.
+type copyLane struct {
+	due  time.Time
+	last chan struct{}
+}
+
+// mirrorRequest is a request queued for the workers of a target. key is the request the sniffer decoded,
+// which pairs the response of the target with the production response. It is nil if the request is not
+// captured by the sniffer.
+type mirrorRequest struct {
+	req *http.Request
+	key *http.Request
+}
+
+func newTarget(proxyCfg *sniff.ProxyCfg, cfg sniff.TargetCfg) (*target, error) {
+	if cfg.Protocol == "" {
+		cfg.Protocol = "http"
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second * clientTimeout
+	}
+
+	if cfg.Workers <= 0 {
+		cfg.Workers = MaxWorkers
+	}
+
+	sampling := proxyCfg.Sampling
+	if cfg.Sampling != nil {
+		sampling = *cfg.Sampling
+	}
+
+	t := &target{cfg: cfg, proxyCfg: proxyCfg, requests: make(chan mirrorRequest)}
+
+	var err error
+
+	t.middlewares, t.sampler, err = requestMiddlewares(
+		t.handlerName(), sampling, proxyCfg.HTTPFilter, cfg.HTTPFilter,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := append(append([]sniff.RewriteRule(nil), proxyCfg.Rewrite...), cfg.Rewrite...)
+
+	t.rewriter, err = sniff.NewRewriter(rules)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "target %s", cfg.Name)
+	}
+
+	amplify := proxyCfg.Amplify
+	if cfg.Amplify != nil {
+		amplify = *cfg.Amplify
+	}
+
+	t.amplifier, err = sniff.NewAmplifier(amplify)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "target %s", cfg.Name)
+	}
+
+	t.stopAmplifying = make(chan struct{})
+	t.copyLanes = make(map[string]*copyLane)
+
+	credentials := proxyCfg.Credentials
+	if cfg.Credentials != nil {
+		credentials = *cfg.Credentials
+	}
+
+	t.credentials, err = sniff.NewCredentials(credentials)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "target %s", cfg.Name)
+	}
+
+	retry, breaker := proxyCfg.Retry, proxyCfg.CircuitBreaker
+	if cfg.Retry != nil {
+		retry = *cfg.Retry
+	}
+
+	if cfg.CircuitBreaker != nil {
+		breaker = *cfg.CircuitBreaker
+	}
+
+	t.delivery, err = sniff.NewDelivery(t.handlerName(), retry, breaker)
+	if err != nil {
+		return nil, err
+	}
+
+	diskQueue := proxyCfg.DiskQueue
+	if cfg.DiskQueue != nil {
+		diskQueue = *cfg.DiskQueue
+	}
+
+	if diskQueue.Dir != "" {
+		// production responses are only kept for the comparer timeout, queued requests may be sent much later
+		if cfg.Compare != nil {
+			return nil, errors.Errorf("target %s can not compare responses with a disk queue", cfg.Name)
+		}
+
+		// queued requests are not tied to the connections they are captured from
+		if t.preservesConnections() {
+			return nil, errors.Errorf("target %s can not preserve connections with a disk queue", cfg.Name)
+		}
+
+		dir := filepath.Join(diskQueue.Dir, cfg.Name)
+
+		t.queue, err = sniff.OpenRequestQueue(t.handlerName(), dir, diskQueue)
+		if err != nil {
+			return nil, err
+		}
+
+		t.stopFeeding = make(chan struct{})
+	}
+
+	tlsCfg := proxyCfg.TLS
+	if cfg.TLS != nil {
+		tlsCfg = *cfg.TLS
+	}
+
+	tlsConfig, err := tlsCfg.Config()
+	if err != nil {
+		return nil, errors.WithMessagef(err, "target %s", cfg.Name)
+	}
+
+	if tlsConfig.InsecureSkipVerify && cfg.Protocol == "https" {
+		log.Printf("target %s: tls certificates are not verified", cfg.Name)
+	}
+
+	transport, err := newTransport(cfg, tlsConfig, false)
+	if err != nil {
+		return nil, err
+	}
+
+	t.tlsConfig = tlsConfig
+
+	t.client = &http.Client{Transport: transport, Timeout: cfg.Timeout}
+
+	if cfg.Compare != nil {
+		report, err := t.reporter(cfg.Compare.Report)
+		if err != nil {
+			return nil, err
+		}
+
+		t.comparer = shadow.NewComparer(t.handlerName(), *cfg.Compare, report)
+	}
+
+	return t, nil
+}
+
+// reporter returns the function that appends the mismatches of the target to path as json lines, or logs
+// them if path is empty.
+func (t *target) reporter(path string) (func(result *shadow.Result), error) {
+	if path == "" {
+		return func(result *shadow.Result) {
+			for _, difference := range result.Differences {
+				log.Printf(
+					"shadow: %s %s %s%s %s differs, production=%s mirror=%s", result.Target, result.Method,
+					result.Host, result.URL, difference.Field, difference.Production, difference.Mirror,
+				)
+			}
+		}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open shadow report %s", path)
+	}
+
+	t.report = file
+
+	var mu sync.Mutex
+
+	encoder := json.NewEncoder(file)
+
+	return func(result *shadow.Result) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if err := encoder.Encode(result); err != nil {
+			log.Printf("failed to write shadow report %s: %s", path, err)
+		}
+	}, nil
+}
+
+// handlerName is the name the handler and the sampler of the target are reported with.
+func (t *target) handlerName() string {
+	if t.cfg.Name == "proxy" {
+		return t.cfg.Name
+	}
+
+	return "proxy-" + t.cfg.Name
+}
+
+func (t *target) baseURL() string {
+	return t.cfg.Protocol + "://" + net.JoinHostPort(t.cfg.Host, t.cfg.Port)
+}
+
+// handler returns the sniffer handler of the target, which queues the requests that pass the filters and
+// the sampling of the target for its workers until ctx is done.
+func (t *target) handler(ctx context.Context) sniff.Handler {
+	return sniff.Chain(
+		func(_ context.Context, req *http.Request) error {
+			return t.send(ctx, req)
+		}, t.middlewares...,
+	)
+}
+
+// start runs the workers of the target until stop is called, or ctx is done. Requests that fail are
+// passed to report.
+func (t *target) start(ctx context.Context, report func(event *sniff.ErrorEvent)) {
+	t.reportError = report
+
+	if t.preservesConnections() {
+		t.upstreams = make(map[string]*upstream)
+	}
+
+	if t.queue != nil {
+		t.feeder.Add(1)
+
+		go func() {
+			defer t.feeder.Done()
+
+			t.feed(ctx, report)
+		}()
+	}
+
+	for i := 0; i < t.cfg.Workers; i++ {
+		t.workers.Add(1)
+
+		go func() {
+			defer t.workers.Done()
+
+			t.work(ctx)
+		}()
+	}
+}
+
+// stop waits for the workers to send the queued requests. Requests in the disk queue are kept there for
+// the next run. No requests should be sent to the target after it is stopped.
+func (t *target) stop() {
+	close(t.stopAmplifying)
+	t.amplifying.Wait()
+
+	if t.queue != nil {
+		close(t.stopFeeding)
+		t.feeder.Wait()
+	}
+
+	close(t.requests)
+	t.workers.Wait()
+	t.closeUpstreams()
+
+	if t.queue != nil {
+		if err := t.queue.Close(); err != nil {
+			log.Printf("failed to close disk queue of %s: %s", t.handlerName(), err)
+		}
+	}
+
+	if t.comparer != nil {
+		t.comparer.Close()
+	}
+
+	if t.report != nil {
+		if err := t.report.Close(); err != nil {
+			log.Printf("failed to close shadow report: %s", err)
+		}
+	}
+}
+
+// work sends the requests of the target until it is stopped, or ctx is done.
+func (t *target) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case mirrored, ok := <-t.requests:
+			if !ok {
+				return
+			}
+
+			t.handle(ctx, t.client, mirrored)
+		}
+	}
+}
+
+// handle sends a request with client. Requests that fail are passed to the error handler, and short
+// circuited ones go back to the disk queue.
+func (t *target) handle(ctx context.Context, client *http.Client, mirrored mirrorRequest) {
+	if t.slots != nil {
+		select {
+		case t.slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		defer func() {
+			<-t.slots
+		}()
+	}
+
+	err := t.do(ctx, client, mirrored)
+	if errors.Is(err, sniff.ErrCircuitOpen) {
+		// short circuited requests are counted by the delivery, reporting every one of them would flood the
+		// error handler while the target is down
+		err = t.requeue(mirrored.req)
+	}
+
+	if err != nil {
+		t.reportError(&sniff.ErrorEvent{Source: t.handlerName(), Request: mirrored.req, Err: err})
+	}
+}
+
+// preservesConnections reports whether the requests of every captured client connection are sent over a
+// connection of their own, in the order they are captured.
+func (t *target) preservesConnections() bool {
+	if t.cfg.PreserveConnections != nil {
+		return *t.cfg.PreserveConnections
+	}
+
+	return t.proxyCfg.PreserveConnections
+}
+
+// feed hands the requests of the disk queue to the workers at the drain rate, until the target is stopped
+// or ctx is done. It waits while the circuit breaker is open, so that the requests stay on disk until the
+// target recovers.
+func (t *target) feed(ctx context.Context, report func(event *sniff.ErrorEvent)) {
+	interval := t.queue.DrainInterval()
+	next := time.Now()
+
+	for {
+		if coolDown := t.delivery.CoolDown(); coolDown > 0 {
+			if !t.sleep(ctx, coolDown) {
+				return
+			}
+
+			continue
+		}
+
+		req, ok, err := t.queue.Pop()
+		if err != nil {
+			report(&sniff.ErrorEvent{Source: t.handlerName(), Err: err})
+
+			// the queue is closed or its files are broken, do not spin on the error
+			if !t.sleep(ctx, time.Second) {
+				return
+			}
+
+			continue
+		}
+
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.stopFeeding:
+				return
+			case <-t.queue.Pushed():
+			}
+
+			continue
+		}
+
+		t.address(req)
+
+		select {
+		case t.requests <- mirrorRequest{req: req}:
+		case <-ctx.Done():
+			_ = t.requeue(req)
+
+			return
+		case <-t.stopFeeding:
+			// the request goes to the end of the queue, it is sent on the next run
+			if err := t.requeue(req); err != nil {
+				report(&sniff.ErrorEvent{Source: t.handlerName(), Request: req, Err: err})
+			}
+
+			return
+		}
+
+		if interval > 0 {
+			now := time.Now()
+			// a feeder that fell behind does not make up for it with a burst
+			if next.Before(now) {
+				next = now
+			}
+
+			next = next.Add(interval)
+
+			if !t.sleep(ctx, next.Sub(now)) {
+				return
+			}
+		}
+	}
+}
+
+// sleep waits for d, and reports false if the target is stopped or ctx is done in the meantime.
+func (t *target) sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.stopFeeding:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// requeue puts a request that is not sent back into the disk queue, to be sent once the target recovers.
+// Requests are dropped if the target has no disk queue.
+func (t *target) requeue(req *http.Request) error {
+	if t.queue == nil {
+		return nil
+	}
+
+	return errors.WithMessagef(t.queue.Push(req), "failed to requeue request to %s", t.handlerName())
+}
+
+// do sends a queued request with client, the retries and the circuit breaker of the target, and passes its
+// response to the comparer if the target compares responses.
+func (t *target) do(ctx context.Context, client *http.Client, mirrored mirrorRequest) error {
+	compare := t.comparer != nil && mirrored.key != nil
+
+	resp, err := t.delivery.Do(
+		ctx, func() (*http.Response, error) {
+			req := mirrored.req.WithContext(ctx)
+
+			// every attempt needs a fresh body, the previous one is consumed
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+
+			req.Body = body
+
+			return client.Do(req)
+		},
+	)
+	if err != nil {
+		if compare {
+			t.comparer.Failed(mirrored.key)
+		}
+
+		return err
+	}
+
+	if !compare {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+		return resp.Body.Close()
+	}
+
+	response, err := t.comparer.ReadResponse(resp)
+	if err != nil {
+		t.comparer.Failed(mirrored.key)
+		_ = resp.Body.Close()
+
+		return err
+	}
+
+	t.comparer.Mirror(mirrored.key, response)
+
+	return resp.Body.Close()
+}
+
+// send queues a copy of req for the workers, addressed to the target but still with the original headers.
+func (t *target) send(ctx context.Context, req *http.Request) error {
+	dupReq := req.Clone(ctx)
+	// modify request so that it goes to the target server but still has the original headers
+	t.address(dupReq)
+
+	// add original client information to x- headers while proxying
+	ip, port, err := net.SplitHostPort(req.RemoteAddr)
+	if t.proxyCfg.AppendXFF {
+		if err != nil {
+			return err
+		}
+
+		dupReq.Header.Add("X-Forwarded-For", ip)
+		dupReq.Header.Set("X-Forwarded-Port", port)
+	}
+
+	if t.proxyCfg.EnableOriginHeaders {
+		dupReq.Header.Set("Gniffer-Connecting-Ip", ip)
+		dupReq.Header.Set("Gniffer-Connecting-Port", port)
+	}
+
+	// production credentials are substituted before the headers of the target, which may set staging ones
+	t.credentials.Substitute(dupReq)
+	t.cfg.Headers.Apply(dupReq.Header)
+
+	if t.isHTTP2() {
+		// requests captured from http/1.1 connections may carry headers that http/2 does not allow
+		for _, name := range hopHeaders {
+			dupReq.Header.Del(name)
+		}
+
+		// an empty user agent stops the client from adding its own, so requests go out as they are captured
+		if _, ok := dupReq.Header["User-Agent"]; !ok {
+			dupReq.Header["User-Agent"] = []string{""}
+		}
+	}
+
+	// should copy the body because the original request body will be emptied, and retries send it again
+	body, err := readBody(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to read request body")
+	}
+
+	dupReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	dupReq.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	if err := t.rewriter.Rewrite(dupReq); err != nil {
+		return errors.WithMessagef(err, "failed to rewrite request to %s", t.handlerName())
+	}
+
+	// copies are made before the request is handed over, a worker may be sending it right after
+	if err := t.amplify(ctx, req, dupReq); err != nil {
+		return err
+	}
+
+	return t.dispatch(ctx, req, dupReq, 0)
+}
+
+// dispatch hands a request to the disk queue, the upstream of its client connection or the workers. req is
+// the captured request it is made from, and index is 0 for the request itself, or the number of a copy.
+func (t *target) dispatch(ctx context.Context, req, out *http.Request, index int) error {
+	if t.queue != nil {
+		return errors.WithMessagef(t.queue.Push(out), "failed to queue request to %s", t.handlerName())
+	}
+
+	mirrored := mirrorRequest{req: out}
+
+	// the production response answers the request once, copies are not compared
+	if event, ok := sniff.RequestEvent(req); ok && index == 0 {
+		mirrored.key = event.Request
+	}
+
+	if t.comparer != nil && mirrored.key != nil {
+		t.comparer.Mirrored(mirrored.key, req)
+	}
+
+	if key, ok := t.upstreamOf(req, index); ok {
+		return t.sendUpstream(ctx, key, mirrored)
+	}
+
+	select {
+	case t.requests <- mirrored:
+	case <-ctx.Done():
+		// the proxy is out of time to shut down, workers are gone
+	}
+
+	return nil
+}
+
+// amplify sends the copies of a request the target sends along with it, after their delays. Copies that
+// are still waiting when the target is stopped are dropped.
+func (t *target) amplify(ctx context.Context, req, dupReq *http.Request) error {
+	if t.amplifier == nil {
+		return nil
+	}
+
+	copies := t.amplifier.Copies()
+
+	for i := 1; i <= copies; i++ {
+		copyReq := dupReq.Clone(ctx)
+
+		body, err := copyReq.GetBody()
+		if err != nil {
+			return errors.Wrap(err, "failed to copy request body")
+		}
+
+		copyReq.Body = body
+
+		if err := t.amplifier.Vary(copyReq); err != nil {
+			return errors.WithMessagef(err, "failed to vary request copy to %s", t.handlerName())
+		}
+
+		due := time.Now().Add(t.amplifier.Delay())
+
+		var (
+			key   string
+			after <-chan struct{}
+			done  chan struct{}
+		)
+
+		if upstream, ok := t.upstreamOf(req, i); ok {
+			key = upstream
+			due, after, done = t.scheduleCopy(key, due)
+		}
+
+		if done == nil && !due.After(time.Now()) {
+			if err := t.dispatch(ctx, req, copyReq, i); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		t.amplifying.Add(1)
+
+		go func(copyReq *http.Request, index int, delay time.Duration) {
+			defer t.amplifying.Done()
+
+			if done != nil {
+				defer t.copyDispatched(key, done)
+			}
+
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.stopAmplifying:
+				return
+			case <-timer.C:
+			}
+
+			if after != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.stopAmplifying:
+					return
+				case <-after:
+				}
+			}
+
+			if err := t.dispatch(ctx, req, copyReq, index); err != nil {
+				t.reportError(&sniff.ErrorEvent{Source: t.handlerName(), Request: copyReq, Err: err})
+			}
+		}(copyReq, i, time.Until(due))
+	}
+
+	return nil
+}
+
+// scheduleCopy delays a copy sent to the upstream key until due, or until the copy before it in the lane
+// of the upstream is due if that is later, so that the copies of a connection are sent in the order of
+// their requests. after is closed once the copy before it is dispatched, and done must be closed with
+// copyDispatched once the copy is dispatched. Both are nil if the copy is due and no copy is waiting in
+// the lane, then it is sent right away.
+func (t *target) scheduleCopy(key string, due time.Time) (time.Time, <-chan struct{}, chan struct{}) {
+	t.copyLanesMu.Lock()
+	defer t.copyLanesMu.Unlock()
+
+	lane, ok := t.copyLanes[key]
+	if !ok {
+		if !due.After(time.Now()) {
+			return due, nil, nil
+		}
+
+		lane = &copyLane{}
+		t.copyLanes[key] = lane
+	}
+
+	if due.Before(lane.due) {
+		due = lane.due
+	}
+
+	after := lane.last
+	done := make(chan struct{})
+	lane.due, lane.last = due, done
+
+	return due, after, done
+}
+
+// copyDispatched lets the next copy of the lane of key go, and forgets the lane if no copy waits in it.
+func (t *target) copyDispatched(key string, done chan struct{}) {
+	close(done)
+
+	t.copyLanesMu.Lock()
+	defer t.copyLanesMu.Unlock()
+
+	if lane, ok := t.copyLanes[key]; ok && lane.last == done {
+		delete(t.copyLanes, key)
+	}
+}
+
+// upstreamOf returns the key of the upstream a request, or its copy with index, is sent to, and false if it
+// is not sent to an upstream. Every copy of a connection gets an upstream of its own, so that copies are
+// sent in parallel.
+func (t *target) upstreamOf(req *http.Request, index int) (string, bool) {
+	if t.upstreams == nil {
+		return "", false
+	}
+
+	key, ok := upstreamKey(req)
+	if !ok {
+		return "", false
+	}
+
+	if index > 0 {
+		key += "#" + strconv.Itoa(index)
+	}
+
+	return key, true
+}
+
+// address points req to the target, keeping its host header.
+func (t *target) address(req *http.Request) {
+	req.URL.Scheme = t.cfg.Protocol
+	req.URL.Host = net.JoinHostPort(t.cfg.Host, t.cfg.Port)
+	// request uri is handled by the client library
+	req.RequestURI = ""
+}
+
+// readBody reads the body of req without consuming it for the other targets.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.GetBody == nil {
+		return ioutil.ReadAll(req.Body)
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
@@ -0,0 +1,105 @@
+package cmd
+
+/*
+Copyright © 2021 strixeye keser@strixeye.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/strixeyecom/gniffer/pkg/sniff"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// idleConnTimeout closes the pooled connections of a target that are idle for longer.
+	idleConnTimeout = time.Second * 90
+	// http2ReadIdleTimeout is how long an http/2 connection may stay silent before it is health checked
+	// with a ping, which has to be answered within http2PingTimeout.
+	http2ReadIdleTimeout = time.Second * 30
+	http2PingTimeout     = time.Second * 15
+	dialTimeout          = time.Second * 10
+)
+
+// hopHeaders are the connection specific headers of http/1.1, which http/2 does not allow.
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"}
+
+// newTransport returns the transport of the http version of a target. Every transport keeps a pool of
+// connections to the target: http/1.1 keeps an idle connection per worker, and http/2 multiplexes the
+// requests of the workers over as few connections as the stream limit of the target allows. A single
+// transport keeps one connection to the target instead, for the upstream of a client connection. http/2
+// transports do not ask for compressed responses, so that requests are sent as they are captured.
+func newTransport(cfg sniff.TargetCfg, tlsConfig *tls.Config, single bool) (http.RoundTripper, error) {
+	switch cfg.HTTPVersion {
+	case "", "1.1":
+		if single {
+			return &http.Transport{
+				TLSClientConfig:     tlsConfig,
+				MaxConnsPerHost:     1,
+				MaxIdleConnsPerHost: 1,
+				IdleConnTimeout:     idleConnTimeout,
+			}, nil
+		}
+
+		return &http.Transport{
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConnsPerHost: cfg.Workers,
+			IdleConnTimeout:     idleConnTimeout,
+		}, nil
+	case "2":
+		if cfg.Protocol != "https" {
+			return nil, errors.Errorf("target %s needs https for http version 2, or h2c without tls", cfg.Name)
+		}
+
+		return &http2.Transport{
+			TLSClientConfig:            tlsConfig,
+			StrictMaxConcurrentStreams: single,
+			ReadIdleTimeout:            http2ReadIdleTimeout,
+			PingTimeout:                http2PingTimeout,
+			DisableCompression:         true,
+		}, nil
+	case "h2c":
+		if cfg.Protocol != "http" {
+			return nil, errors.Errorf("target %s needs http for http version h2c", cfg.Name)
+		}
+
+		dialer := &net.Dialer{Timeout: dialTimeout}
+
+		return &http2.Transport{
+			// h2c speaks http/2 over plain tcp, with prior knowledge instead of an upgrade
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.Dial(network, addr)
+			},
+			StrictMaxConcurrentStreams: single,
+			ReadIdleTimeout:            http2ReadIdleTimeout,
+			PingTimeout:                http2PingTimeout,
+			DisableCompression:         true,
+		}, nil
+	}
+
+	return nil, errors.Errorf(
+		"invalid http version %q of target %s, expected 1.1, 2 or h2c", cfg.HTTPVersion, cfg.Name,
+	)
+}
+
+// isHTTP2 reports whether the target is sent requests over http/2.
+func (t *target) isHTTP2() bool {
+	return t.cfg.HTTPVersion == "2" || t.cfg.HTTPVersion == "h2c"
+}
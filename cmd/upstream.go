@@ -0,0 +1,170 @@
+package cmd
+
+/*
+Copyright © 2021 strixeye keser@strixeye.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/strixeyecom/gniffer/pkg/sniff"
+)
+
+const (
+	// upstreamIdleTimeout closes the upstream of a client connection that sends no requests for longer. The
+	// sniffer does not see connections close, so idle ones are assumed to be closed.
+	upstreamIdleTimeout = time.Minute
+	// upstreamQueueSize is the number of requests of a client connection waiting for its upstream.
+	upstreamQueueSize = 64
+	// maxUpstreamHandlers is the largest number of handler workers that hand the requests of captured
+	// connections to their upstreams. A connection whose upstream falls behind holds back only the
+	// connections that share its handler worker.
+	maxUpstreamHandlers = 64
+)
+
+// upstream sends the requests of a captured client connection to the target over a connection of its own,
+// one at a time in the order they are captured.
+type upstream struct {
+	client   *http.Client
+	requests chan mirrorRequest
+	// pending is the number of requests being handed to the upstream, guarded by the upstreams lock of the
+	// target. An upstream is only closed for being idle when it is 0.
+	pending int
+}
+
+// sendUpstream hands a request to the upstream of the client connection key, and opens the upstream if it
+// is the first request of the connection.
+func (t *target) sendUpstream(ctx context.Context, key string, mirrored mirrorRequest) error {
+	t.upstreamsMu.Lock()
+
+	up, ok := t.upstreams[key]
+	if !ok {
+		transport, err := newTransport(t.cfg, t.tlsConfig, true)
+		if err != nil {
+			t.upstreamsMu.Unlock()
+
+			return err
+		}
+
+		up = &upstream{
+			client:   &http.Client{Transport: transport, Timeout: t.cfg.Timeout},
+			requests: make(chan mirrorRequest, upstreamQueueSize),
+		}
+		t.upstreams[key] = up
+
+		t.upstreamWorkers.Add(1)
+
+		go func() {
+			defer t.upstreamWorkers.Done()
+
+			t.runUpstream(ctx, key, up)
+		}()
+	}
+
+	up.pending++
+	t.upstreamsMu.Unlock()
+
+	select {
+	case up.requests <- mirrored:
+	case <-ctx.Done():
+		// the proxy is out of time to shut down, the upstream is gone
+		t.upstreamsMu.Lock()
+		up.pending--
+		t.upstreamsMu.Unlock()
+	}
+
+	return nil
+}
+
+// runUpstream sends the requests of an upstream until it is idle for upstreamIdleTimeout, the target is
+// stopped or ctx is done, and closes its connection.
+func (t *target) runUpstream(ctx context.Context, key string, up *upstream) {
+	defer up.client.CloseIdleConnections()
+
+	timer := time.NewTimer(upstreamIdleTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case mirrored, ok := <-up.requests:
+			if !ok {
+				return
+			}
+
+			t.upstreamsMu.Lock()
+			up.pending--
+			t.upstreamsMu.Unlock()
+
+			t.handle(ctx, up.client, mirrored)
+
+			if !timer.Stop() {
+				<-timer.C
+			}
+
+			timer.Reset(upstreamIdleTimeout)
+		case <-timer.C:
+			t.upstreamsMu.Lock()
+			if up.pending == 0 {
+				delete(t.upstreams, key)
+				t.upstreamsMu.Unlock()
+
+				return
+			}
+
+			t.upstreamsMu.Unlock()
+
+			timer.Reset(upstreamIdleTimeout)
+		}
+	}
+}
+
+// closeUpstreams waits for the upstreams to send the requests handed to them, and closes them.
+func (t *target) closeUpstreams() {
+	t.upstreamsMu.Lock()
+	for key, up := range t.upstreams {
+		close(up.requests)
+		delete(t.upstreams, key)
+	}
+
+	t.upstreamsMu.Unlock()
+
+	t.upstreamWorkers.Wait()
+}
+
+// upstreamHandlers returns the number of handler workers of a target that preserves connections. Every
+// worker has a queue of its own, so they are bounded by maxUpstreamHandlers even if the target has more
+// workers.
+func (t *target) upstreamHandlers() int {
+	if t.cfg.Workers < maxUpstreamHandlers {
+		return t.cfg.Workers
+	}
+
+	return maxUpstreamHandlers
+}
+
+// upstreamKey returns the client connection a request is captured from, and false if it is not captured
+// by the sniffer.
+func upstreamKey(req *http.Request) (string, bool) {
+	flow, ok := sniff.RequestFlow(req)
+	if !ok {
+		return "", false
+	}
+
+	return flow.String(), true
+}
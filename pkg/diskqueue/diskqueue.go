@@ -0,0 +1,422 @@
+package diskqueue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	contains a fifo queue of byte records kept in segmented append-only files
+*/
+
+const (
+	segmentSuffix = ".seg"
+	cursorName    = "cursor"
+	// headerSize is the size of the length prefix of every record.
+	headerSize = 4
+	// DefaultSegmentSize is the size a segment grows to before records are written to a new one.
+	DefaultSegmentSize = 64 << 20
+)
+
+// ErrClosed is returned when a closed queue is used.
+var ErrClosed = errors.New("queue is closed")
+
+// Queue is a fifo queue of byte records. Records are appended to segment files in a directory, and a
+// segment is deleted once all of its records are read. The read position is kept in the same directory,
+// so a queue opened on an existing directory continues where the previous one stopped.
+type Queue struct {
+	dir         string
+	segmentSize int64
+
+	mu sync.Mutex
+	// segments are the ids of the segment files, oldest first. The last one is being written to.
+	segments []uint64
+	writer   *os.File
+	// writeSize is the size of the segment being written to.
+	writeSize int64
+	reader    *os.File
+	// readOffset is the offset of the next record in the oldest segment.
+	readOffset int64
+	cursor     *os.File
+	count      int
+	// size is the size of the segments.
+	size   int64
+	closed bool
+	// pushed is signalled every time a record is pushed.
+	pushed chan struct{}
+}
+
+// Open opens the queue in dir, creating the directory if it does not exist. segmentSize is the size at
+// which a new segment is started, DefaultSegmentSize if it is not positive.
+func Open(dir string, segmentSize int64) (*Queue, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "failed to create queue directory")
+	}
+
+	q := &Queue{
+		dir:         dir,
+		segmentSize: segmentSize,
+		pushed:      make(chan struct{}, 1),
+	}
+
+	if err := q.load(); err != nil {
+		_ = q.Close()
+
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// load finds the existing segments and the read position in them.
+func (q *Queue) load() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to list queue directory")
+	}
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), segmentSuffix) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		q.segments = append(q.segments, id)
+	}
+
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	q.cursor, err = os.OpenFile(filepath.Join(q.dir, cursorName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open queue cursor")
+	}
+
+	var cursor [16]byte
+	if n, _ := q.cursor.ReadAt(cursor[:], 0); n == len(cursor) && len(q.segments) > 0 &&
+		binary.BigEndian.Uint64(cursor[:8]) == q.segments[0] {
+		q.readOffset = int64(binary.BigEndian.Uint64(cursor[8:]))
+	}
+
+	if len(q.segments) == 0 {
+		q.segments = append(q.segments, 1)
+	}
+
+	last := q.segments[len(q.segments)-1]
+
+	q.writer, err = os.OpenFile(q.segmentPath(last), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open queue segment")
+	}
+
+	info, err := q.writer.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to open queue segment")
+	}
+
+	q.writeSize = info.Size()
+
+	return q.countRecords()
+}
+
+// countRecords counts the unread records of the existing segments.
+func (q *Queue) countRecords() error {
+	for i, id := range q.segments {
+		offset := int64(0)
+		if i == 0 {
+			offset = q.readOffset
+		}
+
+		count, end, size, err := q.segmentRecords(id, offset)
+		if err != nil {
+			return err
+		}
+
+		q.count += count
+		q.size += size
+
+		// a record cut short by a crash can only be at the end of the last segment, remove it so that new
+		// records are appended after the complete ones.
+		if i == len(q.segments)-1 && end < size {
+			if err := q.writer.Truncate(end); err != nil {
+				return errors.Wrap(err, "failed to truncate queue segment")
+			}
+
+			q.writeSize = end
+			q.size -= size - end
+		}
+	}
+
+	return nil
+}
+
+// segmentRecords counts the complete records of a segment from offset. It returns where the last of them
+// ends, and the size of the segment.
+func (q *Queue) segmentRecords(id uint64, offset int64) (count int, end, size int64, err error) {
+	path := q.segmentPath(id)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, 0, errors.Wrap(err, "failed to open queue segment")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, 0, errors.Wrap(err, "failed to open queue segment")
+	}
+
+	defer file.Close()
+
+	for {
+		length, err := readHeader(file, offset)
+		if err != nil || offset+headerSize+int64(length) > info.Size() {
+			return count, offset, info.Size(), nil
+		}
+
+		offset += headerSize + int64(length)
+		count++
+	}
+}
+
+// Push appends a record to the end of the queue.
+func (q *Queue) Push(record []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	if q.writeSize > 0 && q.writeSize+headerSize+int64(len(record)) > q.segmentSize {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, headerSize+len(record))
+	binary.BigEndian.PutUint32(buf, uint32(len(record)))
+	copy(buf[headerSize:], record)
+
+	if _, err := q.writer.Write(buf); err != nil {
+		return errors.Wrap(err, "failed to write record")
+	}
+
+	q.writeSize += int64(len(buf))
+	q.size += int64(len(buf))
+	q.count++
+
+	select {
+	case q.pushed <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// rotate starts writing to a new segment.
+func (q *Queue) rotate() error {
+	id := q.segments[len(q.segments)-1] + 1
+
+	writer, err := os.OpenFile(q.segmentPath(id), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create queue segment")
+	}
+
+	_ = q.writer.Close()
+	q.writer = writer
+	q.writeSize = 0
+	q.segments = append(q.segments, id)
+
+	return nil
+}
+
+// Pop removes and returns the record at the front of the queue. ok is false if the queue is empty.
+func (q *Queue) Pop() (record []byte, ok bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, false, ErrClosed
+	}
+
+	for q.count > 0 {
+		if q.reader == nil {
+			q.reader, err = os.Open(q.segmentPath(q.segments[0]))
+			if err != nil {
+				return nil, false, errors.Wrap(err, "failed to open queue segment")
+			}
+		}
+
+		length, err := readHeader(q.reader, q.readOffset)
+		if errors.Is(err, io.EOF) && len(q.segments) > 1 {
+			// every record of the oldest segment is read
+			if err := q.dropOldestSegment(); err != nil {
+				return nil, false, err
+			}
+
+			continue
+		} else if err != nil {
+			return nil, false, errors.Wrap(err, "failed to read record")
+		}
+
+		record = make([]byte, length)
+		if _, err := q.reader.ReadAt(record, q.readOffset+headerSize); err != nil {
+			return nil, false, errors.Wrap(err, "failed to read record")
+		}
+
+		q.readOffset += headerSize + int64(length)
+		q.count--
+
+		if err := q.saveCursor(); err != nil {
+			return nil, false, err
+		}
+
+		return record, true, nil
+	}
+
+	return nil, false, nil
+}
+
+func (q *Queue) dropOldestSegment() error {
+	if q.reader != nil {
+		_ = q.reader.Close()
+		q.reader = nil
+	}
+
+	path := q.segmentPath(q.segments[0])
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to remove queue segment")
+	}
+
+	if err := os.Remove(path); err != nil {
+		return errors.Wrap(err, "failed to remove queue segment")
+	}
+
+	q.size -= info.Size()
+
+	q.segments = q.segments[1:]
+	q.readOffset = 0
+
+	return q.saveCursor()
+}
+
+func (q *Queue) saveCursor() error {
+	var cursor [16]byte
+
+	binary.BigEndian.PutUint64(cursor[:8], q.segments[0])
+	binary.BigEndian.PutUint64(cursor[8:], uint64(q.readOffset))
+
+	if _, err := q.cursor.WriteAt(cursor[:], 0); err != nil {
+		return errors.Wrap(err, "failed to save queue cursor")
+	}
+
+	return nil
+}
+
+// Pushed returns a channel that receives a value after records are pushed, so that readers can wait for
+// new records instead of polling. A single value may stand for multiple records.
+func (q *Queue) Pushed() <-chan struct{} {
+	return q.pushed
+}
+
+// Len returns the number of records in the queue.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.count
+}
+
+// Size returns the number of bytes used by the segments of the queue, including the records that are
+// already read from the oldest segment.
+func (q *Queue) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.size
+}
+
+// Trim drops the oldest segments until the queue uses at most maxSize bytes, but never the segment being
+// written to. It returns the number of unread records dropped with them.
+func (q *Queue) Trim(maxSize int64) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return 0, ErrClosed
+	}
+
+	dropped := 0
+
+	for q.size > maxSize && len(q.segments) > 1 {
+		count, _, _, err := q.segmentRecords(q.segments[0], q.readOffset)
+		if err != nil {
+			return dropped, err
+		}
+
+		if err := q.dropOldestSegment(); err != nil {
+			return dropped, err
+		}
+
+		q.count -= count
+		dropped += count
+	}
+
+	return dropped, nil
+}
+
+// Close closes the files of the queue. Records that are not popped yet stay in the directory.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+
+	for _, file := range []*os.File{q.writer, q.reader, q.cursor} {
+		if file != nil {
+			_ = file.Close()
+		}
+	}
+
+	return nil
+}
+
+func (q *Queue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+// readHeader reads the length of the record at offset. A partially written header is treated as the end
+// of the segment.
+func readHeader(file *os.File, offset int64) (uint32, error) {
+	var header [headerSize]byte
+
+	n, err := file.ReadAt(header[:], offset)
+	if n < headerSize {
+		if err == nil || errors.Is(err, io.EOF) {
+			return 0, io.EOF
+		}
+
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint32(header[:]), nil
+}
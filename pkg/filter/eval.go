@@ -0,0 +1,419 @@
+package filter
+
+import (
+	"net"
+	"regexp"
+	"strings"
+)
+
+/*
+	contains the type checked nodes of expressions and the operators and methods they are built from
+*/
+
+// kind is the static type of an expression.
+type kind int
+
+const (
+	kindString kind = iota
+	kindNumber
+	kindBool
+	kindIP
+	kindMap
+	kindList
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindString:
+		return "string"
+	case kindNumber:
+		return "number"
+	case kindBool:
+		return "bool"
+	case kindIP:
+		return "ip"
+	case kindMap:
+		return "map"
+	case kindList:
+		return "list"
+	}
+
+	return "unknown"
+}
+
+// node is a compiled expression. eval returns a string, float64, bool, net.IP, mapValue or listValue,
+// as told by kind.
+type node struct {
+	kind kind
+	eval func(e *env) interface{}
+	// isConstant is true for literals, whose value some methods need when they are compiled.
+	isConstant bool
+	value      interface{}
+}
+
+func constant(k kind, value interface{}) *node {
+	return &node{
+		kind:       k,
+		eval:       func(*env) interface{} { return value },
+		isConstant: true,
+		value:      value,
+	}
+}
+
+// mapValue looks up the value of a key of headers, cookies or query parameters.
+type mapValue func(key string) (string, bool)
+
+// listValue is a list literal, whose values are all of the elem kind.
+type listValue struct {
+	elem   kind
+	values []interface{}
+}
+
+func (p *parser) logical(t token, left, right *node) (*node, error) {
+	if left.kind != kindBool || right.kind != kindBool {
+		return nil, p.errorAt(t, "%q needs bool operands, found %s and %s", t.text, left.kind, right.kind)
+	}
+
+	if t.text == "&&" {
+		return &node{
+			kind: kindBool,
+			eval: func(e *env) interface{} { return left.eval(e).(bool) && right.eval(e).(bool) },
+		}, nil
+	}
+
+	return &node{
+		kind: kindBool,
+		eval: func(e *env) interface{} { return left.eval(e).(bool) || right.eval(e).(bool) },
+	}, nil
+}
+
+func (p *parser) not(t token, operand *node) (*node, error) {
+	if operand.kind != kindBool {
+		return nil, p.errorAt(t, "\"!\" needs a bool operand, found %s", operand.kind)
+	}
+
+	return &node{kind: kindBool, eval: func(e *env) interface{} { return !operand.eval(e).(bool) }}, nil
+}
+
+func (p *parser) compare(t token, left, right *node) (*node, error) {
+	switch t.text {
+	case "in":
+		return p.in(t, left, right)
+	case "==", "!=":
+		if !canCompare(left.kind, right.kind) {
+			return nil, p.errorAt(t, "can not compare %s and %s", left.kind, right.kind)
+		}
+
+		negate := t.text == "!="
+
+		return &node{
+			kind: kindBool,
+			eval: func(e *env) interface{} { return equal(left.eval(e), right.eval(e)) != negate },
+		}, nil
+	}
+
+	if left.kind != right.kind || left.kind != kindNumber && left.kind != kindString {
+		return nil, p.errorAt(t, "can not order %s and %s", left.kind, right.kind)
+	}
+
+	// order returns -1, 0 or 1 as the left value is less than, equal to or greater than the right one.
+	order := func(e *env) int {
+		a, b := left.eval(e), right.eval(e)
+
+		if left.kind == kindNumber {
+			switch {
+			case a.(float64) < b.(float64):
+				return -1
+			case a.(float64) > b.(float64):
+				return 1
+			}
+
+			return 0
+		}
+
+		return strings.Compare(a.(string), b.(string))
+	}
+
+	test := map[string]func(order int) bool{
+		"<":  func(order int) bool { return order < 0 },
+		"<=": func(order int) bool { return order <= 0 },
+		">":  func(order int) bool { return order > 0 },
+		">=": func(order int) bool { return order >= 0 },
+	}[t.text]
+
+	return &node{kind: kindBool, eval: func(e *env) interface{} { return test(order(e)) }}, nil
+}
+
+// in reports whether a value is in a list, or a key is in a map.
+func (p *parser) in(t token, left, right *node) (*node, error) {
+	switch right.kind {
+	case kindMap:
+		if left.kind != kindString {
+			return nil, p.errorAt(t, "map keys are strings, found %s", left.kind)
+		}
+
+		return &node{
+			kind: kindBool,
+			eval: func(e *env) interface{} {
+				_, ok := right.eval(e).(mapValue)(left.eval(e).(string))
+
+				return ok
+			},
+		}, nil
+	case kindList:
+		list := right.value.(listValue)
+		if len(list.values) > 0 && !canCompare(left.kind, list.elem) {
+			return nil, p.errorAt(t, "can not look for %s in a list of %s", left.kind, list.elem)
+		}
+
+		return &node{
+			kind: kindBool,
+			eval: func(e *env) interface{} {
+				value := left.eval(e)
+				for _, elem := range list.values {
+					if equal(value, elem) {
+						return true
+					}
+				}
+
+				return false
+			},
+		}, nil
+	}
+
+	return nil, p.errorAt(t, "\"in\" needs a list or a map, found %s", right.kind)
+}
+
+func (p *parser) index(t token, n, key *node) (*node, error) {
+	if n.kind != kindMap {
+		return nil, p.errorAt(t, "can not index %s", n.kind)
+	}
+
+	if key.kind != kindString {
+		return nil, p.errorAt(t, "map keys are strings, found %s", key.kind)
+	}
+
+	return &node{
+		kind: kindString,
+		eval: func(e *env) interface{} {
+			value, _ := n.eval(e).(mapValue)(key.eval(e).(string))
+
+			return value
+		},
+	}, nil
+}
+
+// canCompare reports whether values of the kinds can be checked for equality. ips are compared with the
+// addresses in strings.
+func canCompare(a, b kind) bool {
+	switch {
+	case a == kindMap || a == kindList || b == kindMap || b == kindList:
+		return false
+	case a == b:
+		return true
+	}
+
+	return a == kindIP && b == kindString || a == kindString && b == kindIP
+}
+
+func equal(a, b interface{}) bool {
+	if ip, ok := a.(net.IP); ok {
+		return ipEqual(ip, b)
+	}
+
+	if ip, ok := b.(net.IP); ok {
+		return ipEqual(ip, a)
+	}
+
+	return a == b
+}
+
+func ipEqual(ip net.IP, other interface{}) bool {
+	switch other := other.(type) {
+	case net.IP:
+		return ip != nil && ip.Equal(other)
+	case string:
+		return ip != nil && ip.Equal(net.ParseIP(other))
+	}
+
+	return false
+}
+
+// method compiles a method call on receiver.
+func (p *parser) method(name token, receiver *node, args []*node) (*node, error) {
+	switch receiver.kind {
+	case kindString:
+		return p.stringMethod(name, receiver, args)
+	case kindIP:
+		return p.ipMethod(name, receiver, args)
+	case kindMap:
+		if name.text == "has" {
+			if err := p.checkArgs(name, args, kindString); err != nil {
+				return nil, err
+			}
+
+			return &node{
+				kind: kindBool,
+				eval: func(e *env) interface{} {
+					_, ok := receiver.eval(e).(mapValue)(args[0].eval(e).(string))
+
+					return ok
+				},
+			}, nil
+		}
+	}
+
+	return nil, p.errorAt(name, "%s has no method %q", receiver.kind, name.text)
+}
+
+func (p *parser) stringMethod(name token, receiver *node, args []*node) (*node, error) {
+	str := func(e *env) string { return receiver.eval(e).(string) }
+
+	switch name.text {
+	case "startsWith", "endsWith", "contains":
+		if err := p.checkArgs(name, args, kindString); err != nil {
+			return nil, err
+		}
+
+		test := map[string]func(s, substr string) bool{
+			"startsWith": strings.HasPrefix,
+			"endsWith":   strings.HasSuffix,
+			"contains":   strings.Contains,
+		}[name.text]
+
+		return &node{
+			kind: kindBool,
+			eval: func(e *env) interface{} { return test(str(e), args[0].eval(e).(string)) },
+		}, nil
+	case "matches", "glob":
+		if err := p.checkArgs(name, args, kindString); err != nil {
+			return nil, err
+		}
+
+		if !args[0].isConstant {
+			return nil, p.errorAt(name, "%s needs a string literal", name.text)
+		}
+
+		pattern := args[0].value.(string)
+		if name.text == "glob" {
+			pattern = globPattern(pattern)
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, p.errorAt(name, "invalid pattern: %s", err)
+		}
+
+		return &node{kind: kindBool, eval: func(e *env) interface{} { return re.MatchString(str(e)) }}, nil
+	case "lower", "upper":
+		if err := p.checkArgs(name, args); err != nil {
+			return nil, err
+		}
+
+		convert := strings.ToLower
+		if name.text == "upper" {
+			convert = strings.ToUpper
+		}
+
+		return &node{kind: kindString, eval: func(e *env) interface{} { return convert(str(e)) }}, nil
+	case "size":
+		if err := p.checkArgs(name, args); err != nil {
+			return nil, err
+		}
+
+		return &node{kind: kindNumber, eval: func(e *env) interface{} { return float64(len(str(e))) }}, nil
+	}
+
+	return nil, p.errorAt(name, "string has no method %q", name.text)
+}
+
+func (p *parser) ipMethod(name token, receiver *node, args []*node) (*node, error) {
+	ip := func(e *env) net.IP { return receiver.eval(e).(net.IP) }
+
+	switch name.text {
+	case "inCIDR":
+		if len(args) == 0 {
+			return nil, p.errorAt(name, "inCIDR needs at least one network")
+		}
+
+		networks := make([]*net.IPNet, 0, len(args))
+
+		for _, arg := range args {
+			if arg.kind != kindString || !arg.isConstant {
+				return nil, p.errorAt(name, "inCIDR needs string literals")
+			}
+
+			_, network, err := net.ParseCIDR(arg.value.(string))
+			if err != nil {
+				return nil, p.errorAt(name, "invalid network %q", arg.value)
+			}
+
+			networks = append(networks, network)
+		}
+
+		return &node{
+			kind: kindBool,
+			eval: func(e *env) interface{} {
+				addr := ip(e)
+				for _, network := range networks {
+					if addr != nil && network.Contains(addr) {
+						return true
+					}
+				}
+
+				return false
+			},
+		}, nil
+	case "isPrivate", "isLoopback":
+		if err := p.checkArgs(name, args); err != nil {
+			return nil, err
+		}
+
+		test := net.IP.IsPrivate
+		if name.text == "isLoopback" {
+			test = net.IP.IsLoopback
+		}
+
+		return &node{kind: kindBool, eval: func(e *env) interface{} { return test(ip(e)) }}, nil
+	}
+
+	return nil, p.errorAt(name, "ip has no method %q", name.text)
+}
+
+// checkArgs checks the number and the kinds of the arguments of a method.
+func (p *parser) checkArgs(name token, args []*node, kinds ...kind) error {
+	if len(args) != len(kinds) {
+		return p.errorAt(name, "%s takes %d arguments, found %d", name.text, len(kinds), len(args))
+	}
+
+	for i, arg := range args {
+		if arg.kind != kinds[i] {
+			return p.errorAt(name, "argument %d of %s is %s, not %s", i+1, name.text, arg.kind, kinds[i])
+		}
+	}
+
+	return nil
+}
+
+// globPattern converts a glob, where * matches any characters including slashes and ? matches a single
+// character, to an anchored regular expression.
+func globPattern(glob string) string {
+	var pattern strings.Builder
+
+	pattern.WriteString("^")
+
+	for _, r := range glob {
+		switch r {
+		case '*':
+			pattern.WriteString(".*")
+		case '?':
+			pattern.WriteString(".")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	pattern.WriteString("$")
+
+	return pattern.String()
+}
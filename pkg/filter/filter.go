@@ -0,0 +1,216 @@
+// Package filter is a small expression language that selects http requests by their method, host, path,
+// query parameters, headers, cookies, body and the addresses of their connection, such as
+//
+//	method == "POST" && path.glob("/api/v2/*") && !src_ip.inCIDR("10.0.0.0/8") &&
+//		content_type == "application/json"
+//
+// Expressions are type checked when they are compiled, so a compiled filter only fails to match.
+package filter
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/*
+	contains the compiled filters and the fields of requests they are evaluated against
+*/
+
+// Input is what a filter is evaluated against.
+type Input struct {
+	Request *http.Request
+	// SrcIP and SrcPort are the client side of the connection of the request, and DstIP and DstPort are
+	// the server side. When SrcIP is nil, the client is taken from Request.RemoteAddr.
+	SrcIP   net.IP
+	SrcPort int
+	DstIP   net.IP
+	DstPort int
+}
+
+// Filter is a compiled filter expression. It is safe for concurrent use.
+type Filter struct {
+	expr string
+	root *node
+}
+
+// Compile parses and type checks expr, which must be a boolean expression.
+func Compile(expr string) (*Filter, error) {
+	root, err := parse(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// MustCompile is like Compile but panics if expr is not valid.
+func MustCompile(expr string) *Filter {
+	f, err := Compile(expr)
+	if err != nil {
+		panic(err)
+	}
+
+	return f
+}
+
+// Match reports whether the input matches the filter.
+func (f *Filter) Match(input Input) bool {
+	if input.Request == nil {
+		return false
+	}
+
+	return f.root.eval(newEnv(input)).(bool)
+}
+
+// String returns the expression the filter is compiled from.
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// env is the input of a single evaluation, with the parts of the request that are costly to parse
+// kept once they are needed.
+type env struct {
+	Input
+	query    url.Values
+	bodySize int64
+	bodyRead bool
+}
+
+func newEnv(input Input) *env {
+	e := &env{Input: input}
+
+	if e.SrcIP == nil {
+		host, port, err := net.SplitHostPort(input.Request.RemoteAddr)
+		if err == nil {
+			e.SrcIP = net.ParseIP(host)
+			e.SrcPort, _ = strconv.Atoi(port)
+		}
+	}
+
+	return e
+}
+
+func (e *env) queryValues() url.Values {
+	if e.query == nil {
+		e.query = e.Request.URL.Query()
+	}
+
+	return e.query
+}
+
+// size returns the size of the request body, which is read from GetBody when the request does not tell
+// its content length.
+func (e *env) size() int64 {
+	if e.bodyRead {
+		return e.bodySize
+	}
+
+	e.bodyRead = true
+
+	switch {
+	case e.Request.ContentLength >= 0:
+		e.bodySize = e.Request.ContentLength
+	case e.Request.GetBody != nil:
+		body, err := e.Request.GetBody()
+		if err == nil {
+			e.bodySize, _ = io.Copy(ioutil.Discard, body)
+			_ = body.Close()
+		}
+	}
+
+	return e.bodySize
+}
+
+// variable is a field of the request that expressions refer to by name.
+type variable struct {
+	kind kind
+	get  func(e *env) interface{}
+}
+
+// variables are the fields of requests that expressions can use.
+var variables = map[string]variable{
+	"method": {kindString, func(e *env) interface{} { return strings.ToUpper(e.Request.Method) }},
+	"host":   {kindString, func(e *env) interface{} { return hostOf(e.Request) }},
+	"path":   {kindString, func(e *env) interface{} { return e.Request.URL.Path }},
+	"url":    {kindString, func(e *env) interface{} { return e.Request.URL.RequestURI() }},
+	"query": {
+		kindMap, func(e *env) interface{} {
+			return mapValue(
+				func(key string) (string, bool) {
+					values, ok := e.queryValues()[key]
+					if !ok || len(values) == 0 {
+						return "", false
+					}
+
+					return values[0], true
+				},
+			)
+		},
+	},
+	"headers": {
+		kindMap, func(e *env) interface{} {
+			return mapValue(
+				func(key string) (string, bool) {
+					values := e.Request.Header.Values(key)
+					if len(values) == 0 {
+						return "", false
+					}
+
+					return values[0], true
+				},
+			)
+		},
+	},
+	"cookies": {
+		kindMap, func(e *env) interface{} {
+			return mapValue(
+				func(key string) (string, bool) {
+					cookie, err := e.Request.Cookie(key)
+					if err != nil {
+						return "", false
+					}
+
+					return cookie.Value, true
+				},
+			)
+		},
+	},
+	"body_size":    {kindNumber, func(e *env) interface{} { return float64(e.size()) }},
+	"content_type": {kindString, func(e *env) interface{} { return contentType(e.Request) }},
+	"src_ip":       {kindIP, func(e *env) interface{} { return e.SrcIP }},
+	"src_port":     {kindNumber, func(e *env) interface{} { return float64(e.SrcPort) }},
+	"dst_ip":       {kindIP, func(e *env) interface{} { return e.DstIP }},
+	"dst_port":     {kindNumber, func(e *env) interface{} { return float64(e.DstPort) }},
+}
+
+// hostOf returns the lower case host of the request without the port.
+func hostOf(req *http.Request) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+
+	return strings.ToLower(host)
+}
+
+// contentType returns the lower case media type of the request without its parameters.
+func contentType(req *http.Request) string {
+	header := req.Header.Get("Content-Type")
+
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		mediaType = strings.TrimSpace(strings.SplitN(header, ";", 2)[0])
+	}
+
+	return strings.ToLower(mediaType)
+}
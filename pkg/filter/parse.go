@@ -0,0 +1,471 @@
+package filter
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	contains the lexer and the parser of filter expressions. The grammar, from the lowest precedence:
+
+	or         = and { "||" and }
+	and        = comparison { "&&" comparison }
+	comparison = unary [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" | "in" ) unary ]
+	unary      = "!" unary | postfix
+	postfix    = primary { "." ident "(" [ or { "," or } ] ")" | "[" or "]" }
+	primary    = string | number | "true" | "false" | ident | "(" or ")" | "[" [ literal { "," literal } ] "]"
+*/
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// value is the unquoted string of string tokens and the float64 of number tokens.
+	value interface{}
+	pos   int
+}
+
+// operators are ordered so that two character operators are tried before their prefixes.
+var operators = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ",", "."}
+
+func lex(expr string) ([]token, error) {
+	var tokens []token
+
+	for pos := 0; pos < len(expr); {
+		c := expr[pos]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+		case c == '"' || c == '\'':
+			value, end, err := lexString(expr, pos)
+			if err != nil {
+				return nil, err
+			}
+
+			tokens = append(tokens, token{kind: tokenString, text: expr[pos:end], value: value, pos: pos})
+			pos = end
+		case isDigit(c):
+			end := pos
+			for end < len(expr) && (isDigit(expr[end]) || expr[end] == '.') {
+				end++
+			}
+
+			number, err := strconv.ParseFloat(expr[pos:end], 64)
+			if err != nil {
+				return nil, syntaxError(expr, pos, "invalid number %q", expr[pos:end])
+			}
+
+			tokens = append(tokens, token{kind: tokenNumber, text: expr[pos:end], value: number, pos: pos})
+			pos = end
+		case isLetter(c):
+			end := pos
+			for end < len(expr) && (isLetter(expr[end]) || isDigit(expr[end])) {
+				end++
+			}
+
+			tokens = append(tokens, token{kind: tokenIdent, text: expr[pos:end], pos: pos})
+			pos = end
+		default:
+			operator := ""
+
+			for _, op := range operators {
+				if strings.HasPrefix(expr[pos:], op) {
+					operator = op
+
+					break
+				}
+			}
+
+			if operator == "" {
+				return nil, syntaxError(expr, pos, "unexpected character %q", c)
+			}
+
+			tokens = append(tokens, token{kind: tokenOperator, text: operator, pos: pos})
+			pos += len(operator)
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(expr)}), nil
+}
+
+// lexString reads the quoted string at start, returning its value and where it ends. Only the quote, the
+// backslash, \n and \t are escapes, other backslashes are kept so that regular expressions read as they
+// are written.
+func lexString(expr string, start int) (string, int, error) {
+	quote := expr[start]
+
+	var value strings.Builder
+
+	for pos := start + 1; pos < len(expr); pos++ {
+		c := expr[pos]
+
+		switch {
+		case c == quote:
+			return value.String(), pos + 1, nil
+		case c == '\\' && pos+1 < len(expr):
+			pos++
+
+			switch escaped := expr[pos]; escaped {
+			case quote, '\\':
+				value.WriteByte(escaped)
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			default:
+				value.WriteByte('\\')
+				value.WriteByte(escaped)
+			}
+		default:
+			value.WriteByte(c)
+		}
+	}
+
+	return "", 0, syntaxError(expr, start, "unterminated string")
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func syntaxError(expr string, pos int, format string, args ...interface{}) error {
+	return errors.WithMessagef(
+		errors.Errorf(format, args...), "invalid filter %q at offset %d", expr, pos,
+	)
+}
+
+type parser struct {
+	expr   string
+	tokens []token
+	pos    int
+}
+
+// parse compiles expr into the root node of a boolean expression.
+func parse(expr string) (*node, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{expr: expr, tokens: tokens}
+
+	if p.peek().kind == tokenEOF {
+		return nil, syntaxError(expr, 0, "empty expression")
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if next := p.peek(); next.kind != tokenEOF {
+		return nil, p.errorAt(next, "unexpected %q", next.text)
+	}
+
+	if root.kind != kindBool {
+		return nil, p.errorAt(tokens[0], "expression is %s, not bool", root.kind)
+	}
+
+	return root, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+// accept consumes the next token if it is the operator op.
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokenOperator && t.text == op {
+		p.pos++
+
+		return true
+	}
+
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		if t.kind == tokenEOF {
+			return p.errorAt(t, "expected %q, found end of expression", op)
+		}
+
+		return p.errorAt(t, "expected %q, found %q", op, t.text)
+	}
+
+	return nil
+}
+
+func (p *parser) errorAt(t token, format string, args ...interface{}) error {
+	return syntaxError(p.expr, t.pos, format, args...)
+}
+
+func (p *parser) parseOr() (*node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if !p.accept("||") {
+			return left, nil
+		}
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		if left, err = p.logical(t, left, right); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parseAnd() (*node, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if !p.accept("&&") {
+			return left, nil
+		}
+
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+
+		if left, err = p.logical(t, left, right); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parseComparison() (*node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+
+	isComparison := t.kind == tokenIdent && t.text == "in"
+	if t.kind == tokenOperator {
+		switch t.text {
+		case "==", "!=", "<", "<=", ">", ">=":
+			isComparison = true
+		}
+	}
+
+	if !isComparison {
+		return left, nil
+	}
+
+	p.next()
+
+	right, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	return p.compare(t, left, right)
+}
+
+func (p *parser) parseUnary() (*node, error) {
+	t := p.peek()
+	if !p.accept("!") {
+		return p.parsePostfix()
+	}
+
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	return p.not(t, operand)
+}
+
+func (p *parser) parsePostfix() (*node, error) {
+	n, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch t := p.peek(); {
+		case p.accept("."):
+			name := p.next()
+			if name.kind != tokenIdent {
+				return nil, p.errorAt(name, "expected a method name after \".\"")
+			}
+
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+
+			if n, err = p.method(name, n, args); err != nil {
+				return nil, err
+			}
+		case p.accept("["):
+			key, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+
+			if n, err = p.index(t, n, key); err != nil {
+				return nil, err
+			}
+		default:
+			return n, nil
+		}
+	}
+}
+
+func (p *parser) parseArgs() ([]*node, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	var args []*node
+
+	if p.accept(")") {
+		return args, nil
+	}
+
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, arg)
+
+		if p.accept(")") {
+			return args, nil
+		}
+
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parsePrimary() (*node, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokenString:
+		return constant(kindString, t.value), nil
+	case tokenNumber:
+		return constant(kindNumber, t.value), nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return constant(kindBool, true), nil
+		case "false":
+			return constant(kindBool, false), nil
+		}
+
+		v, ok := variables[t.text]
+		if !ok {
+			return nil, p.errorAt(t, "unknown field %q", t.text)
+		}
+
+		return &node{kind: v.kind, eval: v.get}, nil
+	case tokenOperator:
+		switch t.text {
+		case "(":
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+
+			return n, p.expect(")")
+		case "[":
+			return p.parseList()
+		}
+	case tokenEOF:
+		return nil, p.errorAt(t, "unexpected end of expression")
+	}
+
+	return nil, p.errorAt(t, "unexpected %q", t.text)
+}
+
+// parseList parses a list of string or number literals, after its opening bracket.
+func (p *parser) parseList() (*node, error) {
+	var (
+		values []interface{}
+		elem   = kindString
+	)
+
+	if p.accept("]") {
+		return constant(kindList, listValue{elem: elem}), nil
+	}
+
+	for i := 0; ; i++ {
+		t := p.next()
+
+		switch t.kind {
+		case tokenString, tokenNumber:
+		default:
+			return nil, p.errorAt(t, "lists can only have string or number literals")
+		}
+
+		kind := kindString
+		if t.kind == tokenNumber {
+			kind = kindNumber
+		}
+
+		if i == 0 {
+			elem = kind
+		} else if kind != elem {
+			return nil, p.errorAt(t, "list mixes %s and %s", elem, kind)
+		}
+
+		values = append(values, t.value)
+
+		if p.accept("]") {
+			return constant(kindList, listValue{elem: elem, values: values}), nil
+		}
+
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,311 @@
+// Package metrics is a small registry of counters, gauges and histograms, served in the prometheus text
+// exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	contains the metric types and their exposition
+*/
+
+// Kind is the prometheus type of a metric family.
+type Kind string
+
+const (
+	KindCounter   Kind = "counter"
+	KindGauge     Kind = "gauge"
+	KindHistogram Kind = "histogram"
+)
+
+// contentType is the content type of the prometheus text format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultLatencyBuckets are histogram buckets for request latencies in seconds, from 5ms to 10s.
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// family is a metric family that writes itself in the text format.
+type family interface {
+	write(w *bufio.Writer)
+}
+
+// Registry keeps metric families and serves them on ServeHTTP.
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.families = append(r.families, f)
+}
+
+// ServeHTTP writes every metric family of the registry in the prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+
+	_ = r.Write(w)
+}
+
+// Write writes every metric family of the registry in the prometheus text format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]family(nil), r.families...)
+	r.mu.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(buf)
+	}
+
+	return buf.Flush()
+}
+
+// desc is the name, help and label names of a metric family.
+type desc struct {
+	name   string
+	help   string
+	kind   Kind
+	labels []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.kind)
+}
+
+// writeSample writes a single sample with the label values of the family, and the le label of histogram
+// buckets if le is not empty.
+func (d *desc) writeSample(w *bufio.Writer, suffix string, values []string, le string, value float64) {
+	_, _ = w.WriteString(d.name + suffix)
+
+	labels := make([]string, 0, len(values)+1)
+	for i, value := range values {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", d.labels[i], escapeLabel(value)))
+	}
+
+	if le != "" {
+		labels = append(labels, fmt.Sprintf("le=\"%s\"", le))
+	}
+
+	if len(labels) > 0 {
+		_, _ = w.WriteString("{" + strings.Join(labels, ",") + "}")
+	}
+
+	_, _ = fmt.Fprintf(w, " %s\n", formatFloat(value))
+}
+
+// seriesKey identifies the metric of a family with the label values.
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// CounterVec is a counter family with a counter per combination of label values.
+type CounterVec struct {
+	desc
+	mu       sync.Mutex
+	counters map[string]*counter
+}
+
+type counter struct {
+	values []string
+	value  float64
+}
+
+// NewCounter registers a counter family with the label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:     desc{name: name, help: help, kind: KindCounter, labels: labels},
+		counters: make(map[string]*counter),
+	}
+	r.register(c)
+
+	return c
+}
+
+// Add adds delta to the counter with the label values, which must be in the order of the label names.
+func (c *CounterVec) Add(delta float64, values ...string) {
+	key := seriesKey(values)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctr, ok := c.counters[key]
+	if !ok {
+		ctr = &counter{values: append([]string(nil), values...)}
+		c.counters[key] = ctr
+	}
+
+	ctr.value += delta
+}
+
+// Inc adds one to the counter with the label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeHeader(w)
+
+	keys := make([]string, 0, len(c.counters))
+	for key := range c.counters {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		ctr := c.counters[key]
+		c.writeSample(w, "", ctr.values, "", ctr.value)
+	}
+}
+
+// HistogramVec is a histogram family with a histogram per combination of label values.
+type HistogramVec struct {
+	desc
+	buckets    []float64
+	mu         sync.Mutex
+	histograms map[string]*histogram
+}
+
+type histogram struct {
+	values []string
+	// counts are the non cumulative counts of the buckets, the last one is the +Inf bucket.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram registers a histogram family with the upper bounds of its buckets and the label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+
+	h := &HistogramVec{
+		desc:       desc{name: name, help: help, kind: KindHistogram, labels: labels},
+		buckets:    sorted,
+		histograms: make(map[string]*histogram),
+	}
+	r.register(h)
+
+	return h
+}
+
+// Observe adds value to the histogram with the label values.
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	key := seriesKey(values)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, ok := h.histograms[key]
+	if !ok {
+		hist = &histogram{
+			values: append([]string(nil), values...),
+			counts: make([]uint64, len(h.buckets)+1),
+		}
+		h.histograms[key] = hist
+	}
+
+	hist.counts[sort.SearchFloat64s(h.buckets, value)]++
+	hist.sum += value
+	hist.count++
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.writeHeader(w)
+
+	keys := make([]string, 0, len(h.histograms))
+	for key := range h.histograms {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hist := h.histograms[key]
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			h.writeSample(w, "_bucket", hist.values, formatFloat(bound), float64(cumulative))
+		}
+
+		h.writeSample(w, "_bucket", hist.values, "+Inf", float64(hist.count))
+		h.writeSample(w, "_sum", hist.values, "", hist.sum)
+		h.writeSample(w, "_count", hist.values, "", float64(hist.count))
+	}
+}
+
+// Sample is a value of a metric family collected by a function, with the values of its labels.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// funcFamily is a counter or gauge family whose samples are collected when the registry is written.
+type funcFamily struct {
+	desc
+	collect func() []Sample
+}
+
+// NewFunc registers a counter or gauge family whose samples are returned by collect on every scrape.
+// It is meant for values that are already counted elsewhere.
+func (r *Registry) NewFunc(name, help string, kind Kind, labels []string, collect func() []Sample) {
+	r.register(&funcFamily{desc: desc{name: name, help: help, kind: kind, labels: labels}, collect: collect})
+}
+
+func (f *funcFamily) write(w *bufio.Writer) {
+	f.writeHeader(w)
+
+	for _, sample := range f.collect() {
+		f.writeSample(w, "", sample.LabelValues, "", sample.Value)
+	}
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,401 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/strixeyecom/gniffer/pkg/shadow"
+	"github.com/strixeyecom/gniffer/pkg/sniff"
+)
+
+/*
+	contains the metrics of a sniffer and the red metrics derived from the http traffic it captures
+*/
+
+// Other replaces the host and route labels once a traffic metric has too many of them.
+const Other = "other"
+
+// DefaultMaxSeries is the default limit of distinct host and route pairs of the traffic metrics.
+const DefaultMaxSeries = 10000
+
+// RegisterSniffer registers the counters of sniffer, which are read from its Stats on every scrape.
+func RegisterSniffer(registry *Registry, sniffer sniff.Sniffer) {
+	stat := func(name, help string, kind Kind, value func(stats sniff.Stats) float64) {
+		registry.NewFunc(
+			name, help, kind, nil, func() []Sample {
+				return []Sample{{Value: value(sniffer.Stats())}}
+			},
+		)
+	}
+
+	stat(
+		"gniffer_capture_received_packets_total", "Packets received by the capture mechanism.", KindCounter,
+		func(s sniff.Stats) float64 { return float64(s.Capture.Received) },
+	)
+	stat(
+		"gniffer_capture_dropped_packets_total", "Packets dropped because gniffer did not read them in time.",
+		KindCounter, func(s sniff.Stats) float64 { return float64(s.Capture.Dropped) },
+	)
+	stat(
+		"gniffer_capture_interface_dropped_packets_total", "Packets dropped by the network interface.",
+		KindCounter, func(s sniff.Stats) float64 { return float64(s.Capture.InterfaceDropped) },
+	)
+	stat(
+		"gniffer_decoded_packets_total", "TCP packets handed to the tcp reassembly.", KindCounter,
+		func(s sniff.Stats) float64 { return float64(s.PacketsDecoded) },
+	)
+	stat(
+		"gniffer_non_tcp_packets_total", "Packets skipped because they do not carry tcp.", KindCounter,
+		func(s sniff.Stats) float64 { return float64(s.PacketsNonTCP) },
+	)
+	stat(
+		"gniffer_invalid_packets_total", "Packets skipped because they could not be decoded.", KindCounter,
+		func(s sniff.Stats) float64 { return float64(s.PacketsInvalid) },
+	)
+	stat(
+		"gniffer_active_streams", "TCP streams being decoded.", KindGauge,
+		func(s sniff.Stats) float64 { return float64(s.ActiveStreams) },
+	)
+	stat(
+		"gniffer_flushed_streams_total", "TCP streams closed because they were idle.", KindCounter,
+		func(s sniff.Stats) float64 { return float64(s.FlushedStreams) },
+	)
+	stat(
+		"gniffer_http_parse_errors_total", "Times a stream had data that is not valid http.", KindCounter,
+		func(s sniff.Stats) float64 { return float64(s.HTTPParseErrors) },
+	)
+	stat(
+		"gniffer_mqtt_parse_errors_total", "Times a stream had data that is not valid mqtt.", KindCounter,
+		func(s sniff.Stats) float64 { return float64(s.MQTTParseErrors) },
+	)
+	stat(
+		"gniffer_http_requests_emitted_total", "Decoded http requests.", KindCounter,
+		func(s sniff.Stats) float64 { return float64(s.RequestsEmitted) },
+	)
+	stat(
+		"gniffer_http_responses_emitted_total", "Decoded http responses.", KindCounter,
+		func(s sniff.Stats) float64 { return float64(s.ResponsesEmitted) },
+	)
+	stat(
+		"gniffer_events_emitted_total", "Decoded events of every protocol.", KindCounter,
+		func(s sniff.Stats) float64 { return float64(s.EventsEmitted) },
+	)
+	stat(
+		"gniffer_errors_total", "Failures of streams, handlers and proxied requests reported as error events.",
+		KindCounter, func(s sniff.Stats) float64 { return float64(s.Errors) },
+	)
+	stat(
+		"gniffer_panics_total", "Error events recovered from a panic.", KindCounter,
+		func(s sniff.Stats) float64 { return float64(s.Panics) },
+	)
+
+	handlerStat := func(name, help string, kind Kind, value func(stats sniff.HandlerStats) float64) {
+		registry.NewFunc(
+			name, help, kind, []string{"handler"}, func() []Sample {
+				handlers := sniffer.HandlerStats()
+				samples := make([]Sample, 0, len(handlers))
+
+				for _, handler := range handlers {
+					samples = append(samples, Sample{LabelValues: []string{handler.Name}, Value: value(handler)})
+				}
+
+				return samples
+			},
+		)
+	}
+
+	handlerStat(
+		"gniffer_handler_handled_events_total", "Events a handler finished.", KindCounter,
+		func(s sniff.HandlerStats) float64 { return float64(s.Handled) },
+	)
+	handlerStat(
+		"gniffer_handler_queued_events", "Events waiting for a handler, in memory and on disk.", KindGauge,
+		func(s sniff.HandlerStats) float64 { return float64(s.Queued + s.SpillQueued) },
+	)
+	handlerStat(
+		"gniffer_handler_spilled_events_total", "Events written to disk because a handler queue was full.",
+		KindCounter, func(s sniff.HandlerStats) float64 { return float64(s.Spilled) },
+	)
+	handlerStat(
+		"gniffer_handler_dropped_events_total", "Events dropped because a handler queue was full.",
+		KindCounter, func(s sniff.HandlerStats) float64 { return float64(s.Dropped) },
+	)
+	handlerStat(
+		"gniffer_handler_errors_total", "Errors returned by a handler, including failed retries.", KindCounter,
+		func(s sniff.HandlerStats) float64 { return float64(s.Errors) },
+	)
+	handlerStat(
+		"gniffer_handler_retries_total", "Retries of failed events.", KindCounter,
+		func(s sniff.HandlerStats) float64 { return float64(s.Retries) },
+	)
+	handlerStat(
+		"gniffer_handler_latency_avg_seconds", "Average time a handler took for an event.", KindGauge,
+		func(s sniff.HandlerStats) float64 { return s.AvgLatency.Seconds() },
+	)
+	handlerStat(
+		"gniffer_handler_latency_max_seconds", "Longest time a handler took for an event.", KindGauge,
+		func(s sniff.HandlerStats) float64 { return s.MaxLatency.Seconds() },
+	)
+}
+
+// RegisterSamplers registers the counters of samplers, labeled with their names.
+func RegisterSamplers(registry *Registry, samplers ...*sniff.Sampler) {
+	samplerStat := func(name, help string, value func(stats sniff.SamplingStats) float64) {
+		registry.NewFunc(
+			name, help, KindCounter, []string{"sampler"}, func() []Sample {
+				samples := make([]Sample, 0, len(samplers))
+
+				for _, sampler := range samplers {
+					stats := sampler.Stats()
+					samples = append(samples, Sample{LabelValues: []string{stats.Name}, Value: value(stats)})
+				}
+
+				return samples
+			},
+		)
+	}
+
+	samplerStat(
+		"gniffer_sampled_requests_total", "Requests kept by a sampler.",
+		func(s sniff.SamplingStats) float64 { return float64(s.Sampled) },
+	)
+	samplerStat(
+		"gniffer_unsampled_requests_total", "Requests dropped by the sampling percentage.",
+		func(s sniff.SamplingStats) float64 { return float64(s.Unsampled) },
+	)
+	samplerStat(
+		"gniffer_rate_limited_requests_total", "Requests dropped by the per route cap of a sampler.",
+		func(s sniff.SamplingStats) float64 { return float64(s.RateLimited) },
+	)
+}
+
+// RegisterDeliveries registers the counters and the breaker states of the deliveries to targets, which are
+// read from their Stats on every scrape.
+func RegisterDeliveries(registry *Registry, deliveries ...*sniff.Delivery) {
+	deliveryStat := func(name, help string, kind Kind, value func(stats sniff.DeliveryStats) float64) {
+		registry.NewFunc(
+			name, help, kind, []string{"target"}, func() []Sample {
+				samples := make([]Sample, 0, len(deliveries))
+
+				for _, delivery := range deliveries {
+					stats := delivery.Stats()
+					samples = append(samples, Sample{LabelValues: []string{stats.Name}, Value: value(stats)})
+				}
+
+				return samples
+			},
+		)
+	}
+
+	deliveryStat(
+		"gniffer_target_attempts_total", "Attempts to send mirrored requests to a target, retries included.",
+		KindCounter, func(s sniff.DeliveryStats) float64 { return float64(s.Attempts) },
+	)
+	deliveryStat(
+		"gniffer_target_retries_total", "Retries of mirrored requests to a target.",
+		KindCounter, func(s sniff.DeliveryStats) float64 { return float64(s.Retries) },
+	)
+	deliveryStat(
+		"gniffer_target_failed_requests_total", "Mirrored requests that failed on their last attempt.",
+		KindCounter, func(s sniff.DeliveryStats) float64 { return float64(s.Failed) },
+	)
+	deliveryStat(
+		"gniffer_target_short_circuited_requests_total", "Mirrored requests dropped by an open circuit breaker.",
+		KindCounter, func(s sniff.DeliveryStats) float64 { return float64(s.ShortCircuited) },
+	)
+	deliveryStat(
+		"gniffer_target_breaker_opens_total", "Times the circuit breaker of a target opened.",
+		KindCounter, func(s sniff.DeliveryStats) float64 { return float64(s.BreakerOpens) },
+	)
+	deliveryStat(
+		"gniffer_target_breaker_state", "State of the circuit breaker of a target: 0 closed, 1 half-open, 2 open.",
+		KindGauge, func(s sniff.DeliveryStats) float64 { return float64(s.BreakerState) },
+	)
+}
+
+// RegisterRequestQueues registers the counters of the disk queues of targets, which are read from their
+// Stats on every scrape.
+func RegisterRequestQueues(registry *Registry, queues ...*sniff.RequestQueue) {
+	queueStat := func(name, help string, kind Kind, value func(stats sniff.RequestQueueStats) float64) {
+		registry.NewFunc(
+			name, help, kind, []string{"target"}, func() []Sample {
+				samples := make([]Sample, 0, len(queues))
+
+				for _, queue := range queues {
+					stats := queue.Stats()
+					samples = append(samples, Sample{LabelValues: []string{stats.Name}, Value: value(stats)})
+				}
+
+				return samples
+			},
+		)
+	}
+
+	queueStat(
+		"gniffer_target_queue_requests", "Requests waiting in the disk queue of a target.",
+		KindGauge, func(s sniff.RequestQueueStats) float64 { return float64(s.Queued) },
+	)
+	queueStat(
+		"gniffer_target_queue_bytes", "Disk space used by the disk queue of a target.",
+		KindGauge, func(s sniff.RequestQueueStats) float64 { return float64(s.Size) },
+	)
+	queueStat(
+		"gniffer_target_queue_expired_total", "Requests dropped from a disk queue by its age limit.",
+		KindCounter, func(s sniff.RequestQueueStats) float64 { return float64(s.Expired) },
+	)
+	queueStat(
+		"gniffer_target_queue_trimmed_total", "Requests dropped from a disk queue by its size limit.",
+		KindCounter, func(s sniff.RequestQueueStats) float64 { return float64(s.Trimmed) },
+	)
+}
+
+// RegisterComparers registers the counters of the shadow comparers, which are read from their Stats on every
+// scrape.
+func RegisterComparers(registry *Registry, comparers ...*shadow.Comparer) {
+	comparerStat := func(name, help string, value func(stats shadow.Stats) float64) {
+		registry.NewFunc(
+			name, help, KindCounter, []string{"target"}, func() []Sample {
+				samples := make([]Sample, 0, len(comparers))
+
+				for _, comparer := range comparers {
+					stats := comparer.Stats()
+					samples = append(samples, Sample{LabelValues: []string{stats.Name}, Value: value(stats)})
+				}
+
+				return samples
+			},
+		)
+	}
+
+	comparerStat(
+		"gniffer_shadow_compared_total", "Requests whose production and mirror responses are compared.",
+		func(s shadow.Stats) float64 { return float64(s.Compared) },
+	)
+	comparerStat(
+		"gniffer_shadow_mismatched_total", "Compared requests whose mirror response differs from production.",
+		func(s shadow.Stats) float64 { return float64(s.Mismatched) },
+	)
+	comparerStat(
+		"gniffer_shadow_unpaired_total", "Mirrored requests that did not get both responses in time.",
+		func(s shadow.Stats) float64 { return float64(s.Unpaired) },
+	)
+
+	registry.NewFunc(
+		"gniffer_shadow_mismatches_total", "Mismatched requests by the part of the responses that differs.",
+		KindCounter, []string{"target", "part"}, func() []Sample {
+			samples := make([]Sample, 0, len(comparers)*3)
+
+			for _, comparer := range comparers {
+				stats := comparer.Stats()
+				samples = append(
+					samples,
+					Sample{LabelValues: []string{stats.Name, "status"}, Value: float64(stats.StatusMismatches)},
+					Sample{LabelValues: []string{stats.Name, "header"}, Value: float64(stats.HeaderMismatches)},
+					Sample{LabelValues: []string{stats.Name, "body"}, Value: float64(stats.BodyMismatches)},
+				)
+			}
+
+			return samples
+		},
+	)
+}
+
+// Traffic derives red metrics from the http exchanges a sniffer captures: the request rate, the error
+// rate through the status class label, and the latency between the request and the response.
+type Traffic struct {
+	requests  *CounterVec
+	durations *HistogramVec
+	unmatched *CounterVec
+
+	maxSeries int
+	mu        sync.Mutex
+	series    map[string]struct{}
+}
+
+// NewTraffic registers the traffic metrics. Once maxSeries distinct host and route pairs are seen, new
+// ones are reported as Other, so that unexpected hosts or paths can not grow the metrics without bounds.
+func NewTraffic(registry *Registry, maxSeries int) *Traffic {
+	if maxSeries <= 0 {
+		maxSeries = DefaultMaxSeries
+	}
+
+	labels := []string{"host", "method", "status_class", "route"}
+
+	return &Traffic{
+		requests: registry.NewCounter(
+			"gniffer_traffic_requests_total", "Captured http requests that got a response.", labels...,
+		),
+		durations: registry.NewHistogram(
+			"gniffer_traffic_request_duration_seconds",
+			"Time between the first packets of captured http requests and their responses.",
+			DefaultLatencyBuckets, labels...,
+		),
+		unmatched: registry.NewCounter(
+			"gniffer_traffic_unmatched_responses_total",
+			"Captured http responses whose request is not captured.",
+		),
+		maxSeries: maxSeries,
+		series:    make(map[string]struct{}),
+	}
+}
+
+// Handle is a sniff.EventHandler that observes http response events.
+func (t *Traffic) Handle(ctx context.Context, event sniff.Event) error {
+	responseEvent, ok := event.(*sniff.HTTPResponseEvent)
+	if !ok {
+		return nil
+	}
+
+	if responseEvent.Request == nil {
+		t.unmatched.Inc()
+
+		return nil
+	}
+
+	req := responseEvent.Request
+	host, route := t.limit(hostOf(req.Host), sniff.NormalizeRoute(req.URL.Path))
+	labels := []string{host, req.Method, statusClass(responseEvent.Response.StatusCode), route}
+
+	t.requests.Inc(labels...)
+	t.durations.Observe(responseEvent.Latency().Seconds(), labels...)
+
+	return nil
+}
+
+func (t *Traffic) limit(host, route string) (string, string) {
+	key := host + " " + route
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.series[key]; ok {
+		return host, route
+	}
+
+	if len(t.series) >= t.maxSeries {
+		return Other, Other
+	}
+
+	t.series[key] = struct{}{}
+
+	return host, route
+}
+
+func hostOf(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return strings.ToLower(host)
+	}
+
+	return strings.ToLower(hostport)
+}
+
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+
+	return strconv.Itoa(code/100) + "xx"
+}
@@ -0,0 +1,323 @@
+package shadow
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	contains the comparison of two responses, field by field for json bodies
+*/
+
+const (
+	// maxDifferences is the number of differences reported for a pair of responses, the rest are left out.
+	maxDifferences = 50
+	// maxValueSize is the length values are cut to in differences.
+	maxValueSize = 256
+	// missing is the value of a field one of the responses does not have.
+	missing = "(missing)"
+)
+
+// Difference is a field that differs between the production and the mirror responses. Field is status,
+// header.<name>, body, body.size, or body.<path> for json bodies, where path has the keys and the array
+// indexes separated by dots.
+type Difference struct {
+	Field      string `json:"field"`
+	Production string `json:"production"`
+	Mirror     string `json:"mirror"`
+}
+
+// Kind returns the part of the responses the difference is in: status, header or body.
+func (d Difference) Kind() string {
+	return strings.SplitN(d.Field, ".", 2)[0]
+}
+
+// Response is a response to compare.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	// Body is the whole body, or the first bytes of it if it is larger than the body limit, in which case
+	// Truncated is true.
+	Body      []byte
+	Truncated bool
+}
+
+// Compare returns the differences of the status, the headers of cfg and the body of the responses. json
+// bodies are compared field by field, leaving out the fields in the ignore rules of cfg.
+func Compare(cfg Config, production, mirror *Response) []Difference {
+	d := &differ{ignore: parsePatterns(cfg.IgnoreFields)}
+
+	if production.StatusCode != mirror.StatusCode {
+		d.add("status", strconv.Itoa(production.StatusCode), strconv.Itoa(mirror.StatusCode))
+	}
+
+	for _, name := range cfg.Headers {
+		p, m := headerValue(production.Header, name), headerValue(mirror.Header, name)
+		if p != m {
+			d.add("header."+http.CanonicalHeaderKey(name), p, m)
+		}
+	}
+
+	d.body(production, mirror)
+
+	return d.differences
+}
+
+func headerValue(header http.Header, name string) string {
+	values := header.Values(name)
+	if len(values) == 0 {
+		return missing
+	}
+
+	return strings.Join(values, ", ")
+}
+
+type differ struct {
+	ignore      []pattern
+	differences []Difference
+}
+
+func (d *differ) add(field, production, mirror string) {
+	if len(d.differences) < maxDifferences {
+		d.differences = append(d.differences, Difference{
+			Field: field, Production: cut(production), Mirror: cut(mirror),
+		})
+	}
+}
+
+func (d *differ) body(production, mirror *Response) {
+	p, m := decodedBody(production), decodedBody(mirror)
+
+	if production.Truncated || mirror.Truncated {
+		// a part of a body can not be decoded, at least tell if they are not the same size
+		if len(p) != len(m) || production.Truncated != mirror.Truncated {
+			d.add("body.size", bodySize(production, p), bodySize(mirror, m))
+		}
+
+		return
+	}
+
+	var pValue, mValue interface{}
+	if decodeJSON(p, &pValue) && decodeJSON(m, &mValue) {
+		d.json(nil, pValue, mValue)
+
+		return
+	}
+
+	if !bytes.Equal(p, m) {
+		d.add("body", string(p), string(m))
+	}
+}
+
+func bodySize(resp *Response, body []byte) string {
+	if resp.Truncated {
+		return "more than " + strconv.Itoa(len(body)) + " bytes"
+	}
+
+	return strconv.Itoa(len(body)) + " bytes"
+}
+
+// decodedBody returns the body without its gzip content encoding, since equal bodies may not be
+// compressed to the same bytes.
+func decodedBody(resp *Response) []byte {
+	if resp.Truncated || !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return resp.Body
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(resp.Body))
+	if err != nil {
+		return resp.Body
+	}
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return resp.Body
+	}
+
+	return body
+}
+
+func decodeJSON(body []byte, value *interface{}) bool {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return false
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	return decoder.Decode(value) == nil && !decoder.More()
+}
+
+// json compares two decoded json values at path.
+func (d *differ) json(path []string, p, m interface{}) {
+	if d.ignored(path) {
+		return
+	}
+
+	switch p := p.(type) {
+	case map[string]interface{}:
+		if m, ok := m.(map[string]interface{}); ok {
+			d.object(path, p, m)
+
+			return
+		}
+	case []interface{}:
+		if m, ok := m.([]interface{}); ok {
+			d.array(path, p, m)
+
+			return
+		}
+	case json.Number:
+		if m, ok := m.(json.Number); ok && numbersEqual(p, m) {
+			return
+		}
+	default:
+		if p == m {
+			return
+		}
+	}
+
+	d.add(fieldOf(path), encode(p), encode(m))
+}
+
+func (d *differ) object(path []string, p, m map[string]interface{}) {
+	keys := make([]string, 0, len(p)+len(m))
+	for key := range p {
+		keys = append(keys, key)
+	}
+
+	for key := range m {
+		if _, ok := p[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		d.child(append(path[:len(path):len(path)], key), p, m, key)
+	}
+}
+
+// child compares the values of key in two objects, either of which may not have it.
+func (d *differ) child(path []string, p, m map[string]interface{}, key string) {
+	pValue, pOK := p[key]
+	mValue, mOK := m[key]
+
+	switch {
+	case pOK && mOK:
+		d.json(path, pValue, mValue)
+	case d.ignored(path):
+	case pOK:
+		d.add(fieldOf(path), encode(pValue), missing)
+	default:
+		d.add(fieldOf(path), missing, encode(mValue))
+	}
+}
+
+func (d *differ) array(path []string, p, m []interface{}) {
+	for i := 0; i < len(p) || i < len(m); i++ {
+		elemPath := append(path[:len(path):len(path)], strconv.Itoa(i))
+
+		switch {
+		case i < len(p) && i < len(m):
+			d.json(elemPath, p[i], m[i])
+		case d.ignored(elemPath):
+		case i < len(p):
+			d.add(fieldOf(elemPath), encode(p[i]), missing)
+		default:
+			d.add(fieldOf(elemPath), missing, encode(m[i]))
+		}
+	}
+}
+
+func (d *differ) ignored(path []string) bool {
+	for _, ignore := range d.ignore {
+		if ignore.match(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func numbersEqual(a, b json.Number) bool {
+	if a == b {
+		return true
+	}
+
+	x, errX := a.Float64()
+	y, errY := b.Float64()
+
+	return errX == nil && errY == nil && x == y
+}
+
+func fieldOf(path []string) string {
+	if len(path) == 0 {
+		return "body"
+	}
+
+	return "body." + strings.Join(path, ".")
+}
+
+func encode(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "?"
+	}
+
+	return string(encoded)
+}
+
+func cut(value string) string {
+	if len(value) <= maxValueSize {
+		return value
+	}
+
+	return value[:maxValueSize] + "..."
+}
+
+// pattern is an ignore rule of json fields, such as data.updated_at or items.*.id. A * segment matches
+// any single key or index, and a ** segment matches any number of them.
+type pattern []string
+
+func parsePatterns(rules []string) []pattern {
+	patterns := make([]pattern, 0, len(rules))
+
+	for _, rule := range rules {
+		rule = strings.TrimPrefix(strings.TrimSpace(rule), "body.")
+		if rule != "" {
+			patterns = append(patterns, strings.Split(rule, "."))
+		}
+	}
+
+	return patterns
+}
+
+func (p pattern) match(path []string) bool {
+	if len(p) == 0 {
+		return len(path) == 0
+	}
+
+	if p[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if p[1:].match(path[i:]) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if len(path) == 0 || p[0] != "*" && p[0] != path[0] {
+		return false
+	}
+
+	return p[1:].match(path[1:])
+}
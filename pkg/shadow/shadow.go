@@ -0,0 +1,317 @@
+// Package shadow compares the responses of a mirror target with the production responses of the same
+// requests, to validate that a new build of a service behaves like the one in production.
+package shadow
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	contains the comparer, which pairs the production and the mirror responses of requests
+*/
+
+const (
+	// DefaultTimeout is how long a response waits for the other response of its request by default.
+	DefaultTimeout = time.Second * 30
+	// DefaultMaxBodySize is the default limit of the bodies that are compared.
+	DefaultMaxBodySize = 1 << 20
+	// orphanTimeout is how long a production response waits for its request to be mirrored. Most
+	// requests are never mirrored because of filters and sampling, so it is much shorter than the timeout.
+	orphanTimeout = time.Second * 5
+)
+
+// Config configures the comparison of responses.
+type Config struct {
+	// Headers are the response headers that are compared, besides the status and the body.
+	Headers []string `json:"headers" mapstructure:"HEADERS"`
+	// IgnoreFields are the fields of json bodies that are not compared, such as timestamps and ids. A *
+	// matches any single key or array index, and ** matches any number of them, e.g. data.*.updated_at.
+	IgnoreFields []string `json:"ignore_fields" mapstructure:"IGNORE_FIELDS"`
+	// Report is the file that mismatches are appended to as json lines. They are logged if it is empty.
+	Report string `json:"report" mapstructure:"REPORT"`
+	// Timeout is how long a response waits for the other response of its request. (default: 30s)
+	Timeout time.Duration `json:"timeout" mapstructure:"TIMEOUT"`
+	// MaxBodySize is the largest body that is compared, only the sizes of larger bodies are compared.
+	// (default: 1MB)
+	MaxBodySize int64 `json:"max_body_size" mapstructure:"MAX_BODY_SIZE"`
+}
+
+// Result is the comparison of the responses of a request.
+type Result struct {
+	Target      string       `json:"target"`
+	Time        time.Time    `json:"time"`
+	Method      string       `json:"method"`
+	Host        string       `json:"host"`
+	URL         string       `json:"url"`
+	Differences []Difference `json:"differences"`
+}
+
+// Stats are the counters of a comparer.
+type Stats struct {
+	Name string
+	// Compared is the number of requests whose responses are compared, and Mismatched is the number of
+	// them that have differences. Unpaired is the number of mirrored requests that did not get both
+	// responses in time.
+	Compared   uint64
+	Mismatched uint64
+	Unpaired   uint64
+	// StatusMismatches, HeaderMismatches and BodyMismatches are the number of mismatched requests with
+	// differences in their status, headers and bodies.
+	StatusMismatches uint64
+	HeaderMismatches uint64
+	BodyMismatches   uint64
+}
+
+// Comparer pairs the production and the mirror responses of requests and compares them. Requests are
+// identified by a key, such as the request the sniffer decoded. It is safe for concurrent use.
+type Comparer struct {
+	name   string
+	cfg    Config
+	report func(result *Result)
+
+	mu        sync.Mutex
+	pending   map[interface{}]*pair
+	lastSweep time.Time
+
+	compared         uint64
+	mismatched       uint64
+	unpaired         uint64
+	statusMismatches uint64
+	headerMismatches uint64
+	bodyMismatches   uint64
+}
+
+// pair is a request waiting for one of its responses.
+type pair struct {
+	req        *http.Request
+	mirrored   bool
+	production *Response
+	mirror     *Response
+	deadline   time.Time
+}
+
+// NewComparer creates a comparer whose results are passed to report. name is the target the results and
+// the counters are reported with.
+func NewComparer(name string, cfg Config, report func(result *Result)) *Comparer {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+
+	if cfg.MaxBodySize <= 0 {
+		cfg.MaxBodySize = DefaultMaxBodySize
+	}
+
+	return &Comparer{
+		name:    name,
+		cfg:     cfg,
+		report:  report,
+		pending: make(map[interface{}]*pair),
+	}
+}
+
+// NewResponse returns the response to compare of resp, whose body is already read.
+func (c *Comparer) NewResponse(resp *http.Response, body []byte) *Response {
+	response := &Response{StatusCode: resp.StatusCode, Header: resp.Header, Body: body}
+
+	if int64(len(body)) > c.cfg.MaxBodySize {
+		response.Body = body[:c.cfg.MaxBodySize]
+		response.Truncated = true
+	}
+
+	return response
+}
+
+// ReadResponse reads the response to compare from resp. The body is kept up to the body limit, the rest
+// of it is read and dropped so that the connection can be reused.
+func (c *Comparer) ReadResponse(resp *http.Response) (*Response, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, c.cfg.MaxBodySize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read mirror response")
+	}
+
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return nil, errors.Wrap(err, "failed to read mirror response")
+	}
+
+	return c.NewResponse(resp, body), nil
+}
+
+// Mirrored tells that req is sent to the mirror target, so that its production response is kept until
+// the mirror responds. Production responses of requests that are not mirrored are dropped.
+func (c *Comparer) Mirrored(key interface{}, req *http.Request) {
+	c.update(
+		key, func(p *pair) {
+			p.req = req
+			p.mirrored = true
+		},
+	)
+}
+
+// Production sets the response the production server gave to the request of key.
+func (c *Comparer) Production(key interface{}, resp *Response) {
+	c.update(
+		key, func(p *pair) {
+			p.production = resp
+		},
+	)
+}
+
+// Mirror sets the response the mirror target gave to the request of key.
+func (c *Comparer) Mirror(key interface{}, resp *Response) {
+	c.update(
+		key, func(p *pair) {
+			p.mirror = resp
+		},
+	)
+}
+
+// Failed tells that the mirror target did not respond to the request of key.
+func (c *Comparer) Failed(key interface{}) {
+	c.mu.Lock()
+	_, ok := c.pending[key]
+	delete(c.pending, key)
+	c.mu.Unlock()
+
+	if ok {
+		atomic.AddUint64(&c.unpaired, 1)
+	}
+}
+
+// update changes the pair of key, and compares its responses once it has both of them.
+func (c *Comparer) update(key interface{}, set func(p *pair)) {
+	now := time.Now()
+
+	c.mu.Lock()
+
+	p, ok := c.pending[key]
+	if !ok {
+		p = &pair{}
+		c.pending[key] = p
+	}
+
+	set(p)
+
+	if p.mirrored {
+		p.deadline = now.Add(c.cfg.Timeout)
+	} else {
+		p.deadline = now.Add(orphanTimeout)
+	}
+
+	done := p.mirrored && p.production != nil && p.mirror != nil
+	if done {
+		delete(c.pending, key)
+	}
+
+	expired := c.sweep(now)
+
+	c.mu.Unlock()
+
+	atomic.AddUint64(&c.unpaired, uint64(expired))
+
+	if done {
+		c.compare(p, now)
+	}
+}
+
+// sweep forgets the pairs whose deadline passed, at most once per second. It returns the number of
+// mirrored requests among them.
+func (c *Comparer) sweep(now time.Time) int {
+	if now.Sub(c.lastSweep) < time.Second {
+		return 0
+	}
+
+	c.lastSweep = now
+
+	expired := 0
+
+	for key, p := range c.pending {
+		if now.After(p.deadline) {
+			delete(c.pending, key)
+
+			if p.mirrored {
+				expired++
+			}
+		}
+	}
+
+	return expired
+}
+
+// Close counts the mirrored requests that are still waiting for a response as unpaired.
+func (c *Comparer) Close() {
+	c.mu.Lock()
+
+	unpaired := 0
+
+	for key, p := range c.pending {
+		delete(c.pending, key)
+
+		if p.mirrored {
+			unpaired++
+		}
+	}
+
+	c.mu.Unlock()
+
+	atomic.AddUint64(&c.unpaired, uint64(unpaired))
+}
+
+func (c *Comparer) compare(p *pair, now time.Time) {
+	differences := Compare(c.cfg, p.production, p.mirror)
+
+	atomic.AddUint64(&c.compared, 1)
+
+	if len(differences) == 0 {
+		return
+	}
+
+	atomic.AddUint64(&c.mismatched, 1)
+
+	kinds := make(map[string]bool, 3)
+	for _, difference := range differences {
+		kinds[difference.Kind()] = true
+	}
+
+	if kinds["status"] {
+		atomic.AddUint64(&c.statusMismatches, 1)
+	}
+
+	if kinds["header"] {
+		atomic.AddUint64(&c.headerMismatches, 1)
+	}
+
+	if kinds["body"] {
+		atomic.AddUint64(&c.bodyMismatches, 1)
+	}
+
+	c.report(
+		&Result{
+			Target:      c.name,
+			Time:        now,
+			Method:      p.req.Method,
+			Host:        p.req.Host,
+			URL:         p.req.URL.RequestURI(),
+			Differences: differences,
+		},
+	)
+}
+
+// Stats returns the counters of the comparer.
+func (c *Comparer) Stats() Stats {
+	return Stats{
+		Name:             c.name,
+		Compared:         atomic.LoadUint64(&c.compared),
+		Mismatched:       atomic.LoadUint64(&c.mismatched),
+		Unpaired:         atomic.LoadUint64(&c.unpaired),
+		StatusMismatches: atomic.LoadUint64(&c.statusMismatches),
+		HeaderMismatches: atomic.LoadUint64(&c.headerMismatches),
+		BodyMismatches:   atomic.LoadUint64(&c.bodyMismatches),
+	}
+}
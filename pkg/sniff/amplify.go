@@ -0,0 +1,195 @@
+package sniff
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	contains the amplification of mirrored traffic, which sends copies of every request to load test
+	targets with the shape of real traffic
+*/
+
+// AmplifyCfg configures how many times every request is sent to a target.
+type AmplifyCfg struct {
+	// Factor is the number of times every request is sent, at least 1. The fraction of a factor is the
+	// chance of one more copy, so 2.5 sends every request 2 or 3 times, 2.5 times on average. (default: 1)
+	Factor float64 `json:"factor" mapstructure:"FACTOR"`
+	// Spread delays every copy by a random time up to Spread, so that copies do not arrive together with
+	// the request. 0 sends copies right away.
+	Spread time.Duration `json:"spread" mapstructure:"SPREAD"`
+	// Vary sets fields of the copies to values from pools, so that copies do not hit the caches the request
+	// fills. The request itself is sent as it is.
+	Vary []VaryRule `json:"vary" mapstructure:"VARY"`
+}
+
+// VaryRule sets a field of copies to the values of a pool in turn. The field is selected with one of
+// Header, Cookie, Query or Body, where Body is the dot separated path of a field of a json body such as
+// user.id.
+type VaryRule struct {
+	Header string `json:"header" mapstructure:"HEADER"`
+	Cookie string `json:"cookie" mapstructure:"COOKIE"`
+	Query  string `json:"query" mapstructure:"QUERY"`
+	Body   string `json:"body" mapstructure:"BODY"`
+	// Values is the pool of values, or ValuesFile is a file of one value per line. Lines of body fields
+	// that are json, such as numbers, are set as json values, other lines as strings.
+	Values     []interface{} `json:"values" mapstructure:"VALUES"`
+	ValuesFile string        `json:"values_file" mapstructure:"VALUES_FILE"`
+}
+
+// Amplifier makes copies of requests. It is safe for concurrent use.
+type Amplifier struct {
+	whole  int
+	chance float64
+	spread time.Duration
+	vary   []*varyPool
+}
+
+// varyPool is the rewriter of every value of a vary rule, and next picks the value of the next copy.
+type varyPool struct {
+	rewriters []*Rewriter
+	next      uint64
+}
+
+// NewAmplifier compiles cfg. It returns nil if requests are sent once, which sends no copies.
+func NewAmplifier(cfg AmplifyCfg) (*Amplifier, error) {
+	if cfg.Factor == 0 {
+		cfg.Factor = 1
+	}
+
+	if cfg.Factor < 1 || math.IsInf(cfg.Factor, 0) || math.IsNaN(cfg.Factor) || cfg.Spread < 0 {
+		return nil, errors.New("amplify factor must be at least 1, and spread can not be negative")
+	}
+
+	if cfg.Factor == 1 {
+		return nil, nil
+	}
+
+	whole, fraction := math.Modf(cfg.Factor)
+	a := &Amplifier{whole: int(whole), chance: fraction, spread: cfg.Spread}
+
+	for i, rule := range cfg.Vary {
+		pool, err := compileVary(rule)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "invalid vary rule %d", i)
+		}
+
+		a.vary = append(a.vary, pool)
+	}
+
+	return a, nil
+}
+
+func compileVary(rule VaryRule) (*varyPool, error) {
+	values := rule.Values
+
+	if rule.ValuesFile != "" {
+		if len(values) > 0 {
+			return nil, errors.New("values can be listed or read from a file, not both")
+		}
+
+		lines, err := readValues(rule.ValuesFile, rule.Body != "")
+		if err != nil {
+			return nil, err
+		}
+
+		values = lines
+	}
+
+	if len(values) == 0 {
+		return nil, errors.New("vary rule needs values or values_file")
+	}
+
+	pool := &varyPool{rewriters: make([]*Rewriter, 0, len(values))}
+
+	for _, value := range values {
+		rewriter, err := NewRewriter(
+			[]RewriteRule{{Header: rule.Header, Cookie: rule.Cookie, Query: rule.Query, Body: rule.Body, Set: value}},
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		pool.rewriters = append(pool.rewriters, rewriter)
+	}
+
+	return pool, nil
+}
+
+// readValues reads the non empty lines of a file. Lines that are json are decoded if asJSON is true.
+func readValues(path string, asJSON bool) ([]interface{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open vary values")
+	}
+
+	defer file.Close()
+
+	var values []interface{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var value interface{} = line
+
+		if asJSON {
+			decoder := json.NewDecoder(bytes.NewReader([]byte(line)))
+			decoder.UseNumber()
+
+			var decoded interface{}
+			if decoder.Decode(&decoded) == nil && !decoder.More() {
+				value = decoded
+			}
+		}
+
+		values = append(values, value)
+	}
+
+	return values, errors.Wrap(scanner.Err(), "failed to read vary values")
+}
+
+// Copies returns the number of copies to send along with the next request.
+func (a *Amplifier) Copies() int {
+	copies := a.whole - 1
+	if a.chance > 0 && rand.Float64() < a.chance { // nolint:gosec // amplification does not need crypto rand
+		copies++
+	}
+
+	return copies
+}
+
+// Delay returns how long to wait before sending the next copy.
+func (a *Amplifier) Delay() time.Duration {
+	if a.spread == 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(a.spread))) // nolint:gosec // spreading does not need crypto rand
+}
+
+// Vary sets the fields of a copy to the next values of their pools.
+func (a *Amplifier) Vary(req *http.Request) error {
+	for _, pool := range a.vary {
+		i := (atomic.AddUint64(&pool.next, 1) - 1) % uint64(len(pool.rewriters))
+
+		if err := pool.rewriters[i].Rewrite(req); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,287 @@
+package sniff
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	contains the substitution of the credentials of mirrored requests, so that production tokens, api keys
+	and session cookies do not reach lower environments
+*/
+
+// CredentialsCfg configures which parts of requests are credentials, and what is sent instead of them.
+type CredentialsCfg struct {
+	// Enabled substitutes the credentials. The Authorization header is always a credential.
+	Enabled bool `json:"enabled" mapstructure:"ENABLED"`
+	// Headers and Cookies are the names of the other headers and cookies that are credentials, such as
+	// X-Api-Key or session.
+	Headers []string `json:"headers" mapstructure:"HEADERS"`
+	Cookies []string `json:"cookies" mapstructure:"COOKIES"`
+	// Rules substitute credentials, the ones without a rule are dropped.
+	Rules []CredentialRule `json:"rules" mapstructure:"RULES"`
+}
+
+// CredentialRule substitutes the credential in a header or a cookie, selected with one of Header or Cookie.
+// The header or cookie is a credential even if it is not in the Headers or Cookies of the config.
+//
+// The drop action removes the credential. The static action replaces it with the value read from
+// ValueFile or ValueEnv. The map action reads Key from the request, and replaces the credential with the
+// value of the key in the json object of TableFile. Credentials whose key is missing from the request or
+// the table get the static value if there is one, and are dropped if there is not.
+//
+// Values replace the whole header or cookie value, so the value of the Authorization header includes its
+// scheme, e.g. "Bearer <token>".
+type CredentialRule struct {
+	Header string `json:"header" mapstructure:"HEADER"`
+	Cookie string `json:"cookie" mapstructure:"COOKIE"`
+	// Action is drop, static or map. (default: drop)
+	Action    string `json:"action" mapstructure:"ACTION"`
+	ValueFile string `json:"value_file" mapstructure:"VALUE_FILE"`
+	ValueEnv  string `json:"value_env" mapstructure:"VALUE_ENV"`
+	// Key is client_ip, header:<name>, cookie:<name>, or claim:<name> for a claim of the bearer token such
+	// as claim:tenant_id or claim:org.id. It is read before any credential is substituted.
+	Key       string `json:"key" mapstructure:"KEY"`
+	TableFile string `json:"table_file" mapstructure:"TABLE_FILE"`
+}
+
+// Credentials substitutes the credentials of requests. It is safe for concurrent use.
+type Credentials struct {
+	headers map[string]*credential
+	cookies map[string]*credential
+}
+
+// credential is the substitution of a credential. It is dropped if it has no static value and no table.
+type credential struct {
+	value    string
+	hasValue bool
+	key      func(req *http.Request) (string, bool)
+	table    map[string]string
+}
+
+// NewCredentials reads the values and tables of the rules. It returns nil if cfg is not enabled, which
+// leaves requests as they are.
+func NewCredentials(cfg CredentialsCfg) (*Credentials, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	c := &Credentials{
+		headers: map[string]*credential{"Authorization": {}},
+		cookies: make(map[string]*credential, len(cfg.Cookies)),
+	}
+
+	for _, name := range cfg.Headers {
+		c.headers[textproto.CanonicalMIMEHeaderKey(name)] = &credential{}
+	}
+
+	for _, name := range cfg.Cookies {
+		c.cookies[name] = &credential{}
+	}
+
+	for i, rule := range cfg.Rules {
+		if (rule.Header == "") == (rule.Cookie == "") {
+			return nil, errors.Errorf("credential rule %d needs one of a header or a cookie", i)
+		}
+
+		cred, err := compileCredential(rule)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "invalid credential rule %d", i)
+		}
+
+		if rule.Header != "" {
+			c.headers[textproto.CanonicalMIMEHeaderKey(rule.Header)] = cred
+		} else {
+			c.cookies[rule.Cookie] = cred
+		}
+	}
+
+	return c, nil
+}
+
+func compileCredential(rule CredentialRule) (*credential, error) {
+	cred := &credential{}
+
+	if rule.ValueFile != "" && rule.ValueEnv != "" {
+		return nil, errors.New("value can be read from a file or an env variable, not both")
+	}
+
+	if rule.ValueFile != "" {
+		raw, err := ioutil.ReadFile(rule.ValueFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read credential value")
+		}
+
+		cred.value, cred.hasValue = strings.TrimSpace(string(raw)), true
+	}
+
+	if rule.ValueEnv != "" {
+		value, ok := os.LookupEnv(rule.ValueEnv)
+		if !ok {
+			return nil, errors.Errorf("env variable %s of the credential value is not set", rule.ValueEnv)
+		}
+
+		cred.value, cred.hasValue = strings.TrimSpace(value), true
+	}
+
+	switch strings.ToLower(rule.Action) {
+	case "", "drop":
+		if cred.hasValue || rule.Key != "" || rule.TableFile != "" {
+			return nil, errors.New("drop action does not take a value, key or table")
+		}
+	case "static":
+		if !cred.hasValue {
+			return nil, errors.New("static action needs value_file or value_env")
+		}
+
+		if rule.Key != "" || rule.TableFile != "" {
+			return nil, errors.New("static action does not take a key or table")
+		}
+	case "map":
+		if rule.Key == "" || rule.TableFile == "" {
+			return nil, errors.New("map action needs a key and table_file")
+		}
+
+		key, err := requestKey(rule.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		raw, err := ioutil.ReadFile(rule.TableFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read credential table")
+		}
+
+		if err := json.Unmarshal(raw, &cred.table); err != nil {
+			return nil, errors.Wrapf(err, "credential table %s is not a json object of strings", rule.TableFile)
+		}
+
+		cred.key = key
+	default:
+		return nil, errors.Errorf("unknown action %q, expected drop, static or map", rule.Action)
+	}
+
+	return cred, nil
+}
+
+// substitute returns the value that replaces the credential of req, and false if it is dropped.
+func (c *credential) substitute(req *http.Request) (string, bool) {
+	if c.key != nil {
+		if key, ok := c.key(req); ok {
+			if value, ok := c.table[key]; ok {
+				return value, true
+			}
+		}
+	}
+
+	return c.value, c.hasValue
+}
+
+// Substitute drops or replaces the credentials of req. Every substitution is decided before any is made,
+// so that keys can be read from credentials that are dropped.
+func (c *Credentials) Substitute(req *http.Request) {
+	if c == nil {
+		return
+	}
+
+	headers := make(map[string]*string)
+
+	for name, cred := range c.headers {
+		if _, ok := req.Header[name]; !ok {
+			continue
+		}
+
+		var replacement *string
+		if value, ok := cred.substitute(req); ok {
+			replacement = &value
+		}
+
+		headers[name] = replacement
+	}
+
+	cookies, changed := req.Cookies(), false
+	kept := cookies[:0]
+
+	for _, cookie := range cookies {
+		cred, ok := c.cookies[cookie.Name]
+		if !ok {
+			kept = append(kept, cookie)
+
+			continue
+		}
+
+		changed = true
+
+		if value, ok := cred.substitute(req); ok {
+			cookie.Value = value
+			kept = append(kept, cookie)
+		}
+	}
+
+	for name, replacement := range headers {
+		if replacement == nil {
+			req.Header.Del(name)
+		} else {
+			req.Header.Set(name, *replacement)
+		}
+	}
+
+	if changed {
+		req.Header.Del("Cookie")
+
+		for _, cookie := range kept {
+			req.AddCookie(cookie)
+		}
+	}
+}
+
+// bearerClaim returns the claim of the json web token in the Authorization header of the request. The
+// name is the dot separated path of the claim, and the signature of the token is not verified.
+func bearerClaim(req *http.Request, name string) (string, bool) {
+	auth := req.Header.Get("Authorization")
+	if len(auth) < len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+
+	parts := strings.Split(strings.TrimSpace(auth[len("Bearer "):]), ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", false
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+
+	var claims interface{}
+	if err := decoder.Decode(&claims); err != nil {
+		return "", false
+	}
+
+	for _, key := range strings.Split(name, ".") {
+		if claims = getField(claims, key); claims == nil {
+			return "", false
+		}
+	}
+
+	switch claim := claims.(type) {
+	case string:
+		return claim, claim != ""
+	case json.Number, bool:
+		return fmt.Sprint(claim), true
+	}
+
+	return "", false
+}
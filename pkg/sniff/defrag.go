@@ -0,0 +1,56 @@
+package sniff
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/layers"
+	"github.com/pkg/errors"
+)
+
+/*
+	contains the reassembly of fragmented ipv4 packets
+*/
+
+// defragment returns the packet itself if it is not an ipv4 fragment. For fragments, it returns nil
+// until the last missing fragment arrives, and then the reassembled packet.
+func defragment(defragmenter *ip4defrag.IPv4Defragmenter, packet gopacket.Packet) (gopacket.Packet, error) {
+	layer := packet.Layer(layers.LayerTypeIPv4)
+	if layer == nil {
+		return packet, nil
+	}
+
+	ipv4, ok := layer.(*layers.IPv4)
+	if !ok {
+		return nil, errors.New("IPv4 layer is not a valid network layer")
+	}
+
+	if ipv4.Flags&layers.IPv4MoreFragments == 0 && ipv4.FragOffset == 0 {
+		return packet, nil
+	}
+
+	reassembled, err := defragmenter.DefragIPv4WithTimestamp(ipv4, packet.Metadata().Timestamp)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to defragment packet")
+	}
+
+	if reassembled == nil {
+		return nil, nil
+	}
+
+	// re-encode the datagram, so that the layers inside it are decoded like any other packet
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+
+	err = gopacket.SerializeLayers(buf, opts, reassembled, gopacket.Payload(reassembled.Payload))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode defragmented packet")
+	}
+
+	defragmented := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	metadata := defragmented.Metadata()
+	metadata.Timestamp = packet.Metadata().Timestamp
+	metadata.CaptureLength = len(buf.Bytes())
+	metadata.Length = len(buf.Bytes())
+
+	return defragmented, nil
+}
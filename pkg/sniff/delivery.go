@@ -0,0 +1,331 @@
+package sniff
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	contains the delivery of mirrored requests to a target, with retries and a circuit breaker that stops
+	sending to a target that keeps failing
+*/
+
+const (
+	defaultDeliveryBackoff    = time.Millisecond * 100
+	defaultDeliveryMaxBackoff = time.Second * 10
+	defaultBreakerCoolDown    = time.Second * 30
+)
+
+// ErrCircuitOpen is returned by Delivery.Do when the circuit breaker does not let the request through.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// RetryCfg configures how many times a request is sent to a target, and how long to wait in between.
+type RetryCfg struct {
+	// Attempts is the number of times a request is sent before giving up. (default: 1, no retries)
+	Attempts int `json:"attempts" mapstructure:"ATTEMPTS"`
+	// Backoff is the wait before the first retry, doubled for every following one up to MaxBackoff. Waits
+	// are jittered between half and all of their length, so that retries of many requests spread out.
+	// (default: 100ms)
+	Backoff time.Duration `json:"backoff" mapstructure:"BACKOFF"`
+	// MaxBackoff is the longest wait between two attempts. (default: 10s)
+	MaxBackoff time.Duration `json:"max_backoff" mapstructure:"MAX_BACKOFF"`
+	// StatusCodes are the response statuses that are retried, such as 502, 503 and 504. Transport errors
+	// are always retried.
+	StatusCodes []int `json:"status_codes" mapstructure:"STATUS_CODES"`
+}
+
+// BreakerCfg configures the circuit breaker of a target.
+type BreakerCfg struct {
+	// Failures is the number of consecutive failed attempts that open the breaker, 0 disables it.
+	Failures int `json:"failures" mapstructure:"FAILURES"`
+	// CoolDown is how long the breaker stays open before a request probes the target again.
+	// (default: 30s)
+	CoolDown time.Duration `json:"cool_down" mapstructure:"COOL_DOWN"`
+}
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int32
+
+const (
+	// BreakerClosed lets every request through.
+	BreakerClosed BreakerState = iota
+	// BreakerHalfOpen lets a single probe request through after the cool down, which closes the breaker
+	// if it succeeds and opens it again if it fails.
+	BreakerHalfOpen
+	// BreakerOpen drops every request until the cool down is over.
+	BreakerOpen
+)
+
+var breakerStateNames = map[BreakerState]string{
+	BreakerClosed:   "closed",
+	BreakerHalfOpen: "half-open",
+	BreakerOpen:     "open",
+}
+
+func (s BreakerState) String() string {
+	if name, ok := breakerStateNames[s]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// DeliveryStats are the counters of a delivery.
+type DeliveryStats struct {
+	Name string
+	// Attempts is the number of times requests are sent, and Retries is the number of them that are
+	// retries. Failed is the number of requests that still failed on their last attempt, and
+	// ShortCircuited is the number of requests dropped by the open breaker.
+	Attempts       uint64
+	Retries        uint64
+	Failed         uint64
+	ShortCircuited uint64
+	// BreakerState is the current state of the breaker, and BreakerOpens is the number of times it opened.
+	BreakerState BreakerState
+	BreakerOpens uint64
+}
+
+// Delivery sends requests to a target with retries and a circuit breaker. It is safe for concurrent use.
+type Delivery struct {
+	name      string
+	retry     RetryCfg
+	breaker   BreakerCfg
+	retryable map[int]bool
+
+	mu sync.Mutex
+	// state is read without the lock for the stats, it is only written with it.
+	state    int32
+	failures int
+	openedAt time.Time
+	probing  bool
+
+	attempts       uint64
+	retries        uint64
+	failed         uint64
+	shortCircuited uint64
+	breakerOpens   uint64
+}
+
+// NewDelivery creates a delivery, whose counters are reported with name.
+func NewDelivery(name string, retry RetryCfg, breaker BreakerCfg) (*Delivery, error) {
+	if retry.Attempts < 0 || retry.Backoff < 0 || retry.MaxBackoff < 0 {
+		return nil, errors.Errorf("retry of %s can not have negative attempts or backoff", name)
+	}
+
+	if breaker.Failures < 0 || breaker.CoolDown < 0 {
+		return nil, errors.Errorf("circuit breaker of %s can not have negative failures or cool down", name)
+	}
+
+	if retry.Attempts == 0 {
+		retry.Attempts = 1
+	}
+
+	if retry.Backoff == 0 {
+		retry.Backoff = defaultDeliveryBackoff
+	}
+
+	if retry.MaxBackoff == 0 {
+		retry.MaxBackoff = defaultDeliveryMaxBackoff
+	}
+
+	if breaker.CoolDown == 0 {
+		breaker.CoolDown = defaultBreakerCoolDown
+	}
+
+	retryable := make(map[int]bool, len(retry.StatusCodes))
+	for _, status := range retry.StatusCodes {
+		retryable[status] = true
+	}
+
+	return &Delivery{name: name, retry: retry, breaker: breaker, retryable: retryable}, nil
+}
+
+// Do sends a request with send until it gets a response whose status is not retried, or runs out of
+// attempts. The response of the last attempt is returned even if its status is retried, and the caller
+// must close its body. ErrCircuitOpen is returned when the breaker does not let an attempt through.
+func (d *Delivery) Do(ctx context.Context, send func() (*http.Response, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		allowed, probe := d.allow(time.Now())
+		if !allowed {
+			atomic.AddUint64(&d.shortCircuited, 1)
+
+			return nil, ErrCircuitOpen
+		}
+
+		atomic.AddUint64(&d.attempts, 1)
+
+		if attempt > 1 {
+			atomic.AddUint64(&d.retries, 1)
+		}
+
+		resp, err := send()
+		ok := err == nil && !d.retryable[resp.StatusCode]
+
+		d.record(ok, probe, time.Now())
+
+		if ok {
+			return resp, nil
+		}
+
+		if attempt >= d.retry.Attempts {
+			atomic.AddUint64(&d.failed, 1)
+
+			return resp, err
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+
+		timer := time.NewTimer(d.backoff(attempt))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			atomic.AddUint64(&d.failed, 1)
+
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns the jittered wait after the attempt.
+func (d *Delivery) backoff(attempt int) time.Duration {
+	backoff := d.retry.Backoff
+	for i := 1; i < attempt && backoff < d.retry.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > d.retry.MaxBackoff {
+		backoff = d.retry.MaxBackoff
+	}
+
+	half := backoff / 2
+	jitter := rand.Int63n(int64(backoff-half) + 1) // nolint:gosec // jitter does not need crypto rand
+
+	return half + time.Duration(jitter)
+}
+
+// allow reports whether the breaker lets an attempt through, and lets the probe through once the cool down
+// is over. probe reports whether the attempt is the probe, whose result decides the next probe.
+func (d *Delivery) allow(now time.Time) (allowed, probe bool) {
+	if d.breaker.Failures == 0 {
+		return true, false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch BreakerState(d.state) {
+	case BreakerClosed:
+		return true, false
+	case BreakerOpen:
+		if now.Sub(d.openedAt) < d.breaker.CoolDown {
+			return false, false
+		}
+
+		atomic.StoreInt32(&d.state, int32(BreakerHalfOpen))
+		d.probing = true
+
+		return true, true
+	default:
+		// only the probe goes through while the breaker is half open
+		if d.probing {
+			return false, false
+		}
+
+		d.probing = true
+
+		return true, true
+	}
+}
+
+// CoolDown returns how long the open breaker keeps dropping requests, 0 if it lets them through.
+func (d *Delivery) CoolDown() time.Duration {
+	if d.breaker.Failures == 0 {
+		return 0
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if BreakerState(d.state) != BreakerOpen {
+		return 0
+	}
+
+	if left := d.breaker.CoolDown - time.Since(d.openedAt); left > 0 {
+		return left
+	}
+
+	return 0
+}
+
+// record updates the breaker with the result of an attempt. Attempts that were let through before the
+// breaker opened may finish while it is open or half open, only the result of the probe closes or opens it
+// then.
+func (d *Delivery) record(ok, probe bool, now time.Time) {
+	if d.breaker.Failures == 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state := BreakerState(d.state)
+
+	if state != BreakerClosed && !probe {
+		return
+	}
+
+	if probe {
+		d.probing = false
+	}
+
+	if ok {
+		d.failures = 0
+
+		if state != BreakerClosed {
+			atomic.StoreInt32(&d.state, int32(BreakerClosed))
+			log.Printf("target %s: circuit breaker closed", d.name)
+		}
+
+		return
+	}
+
+	d.failures++
+
+	if state == BreakerHalfOpen || state == BreakerClosed && d.failures >= d.breaker.Failures {
+		atomic.StoreInt32(&d.state, int32(BreakerOpen))
+		atomic.AddUint64(&d.breakerOpens, 1)
+		d.openedAt = now
+
+		log.Printf(
+			"target %s: circuit breaker opened after %d consecutive failures, probing again in %s", d.name,
+			d.failures, d.breaker.CoolDown,
+		)
+	}
+}
+
+// Stats returns the counters of the delivery.
+func (d *Delivery) Stats() DeliveryStats {
+	return DeliveryStats{
+		Name:           d.name,
+		Attempts:       atomic.LoadUint64(&d.attempts),
+		Retries:        atomic.LoadUint64(&d.retries),
+		Failed:         atomic.LoadUint64(&d.failed),
+		ShortCircuited: atomic.LoadUint64(&d.shortCircuited),
+		BreakerState:   BreakerState(atomic.LoadInt32(&d.state)),
+		BreakerOpens:   atomic.LoadUint64(&d.breakerOpens),
+	}
+}
@@ -0,0 +1,89 @@
+package sniff
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	contains the error events, which keep a failing stream or handler from taking down the sniffer
+*/
+
+// ErrorEvent reports an error of a stream decoder, a handler, or the work done for an event outside the
+// sniffer. The stream or the event fails alone, the sniffer keeps running.
+type ErrorEvent struct {
+	// Flow is the tcp stream of the failure, it is zero when the failure is not tied to a stream.
+	Flow
+	// Source is what failed, such as "http stream", "mqtt stream" or the name of a handler.
+	Source string
+	// Request is the http request that was being handled, if any.
+	Request *http.Request
+	Err     error
+	// Panicked is true if Err is recovered from a panic.
+	Panicked bool
+}
+
+// Error implements error.
+func (e *ErrorEvent) Error() string {
+	if e.Flow == (Flow{}) {
+		return fmt.Sprintf("%s: %s", e.Source, e.Err)
+	}
+
+	return fmt.Sprintf("%s %s: %s", e.Source, e.Flow, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ErrorEvent) Unwrap() error {
+	return e.Err
+}
+
+// ErrorHandler receives the error events of a sniffer. It runs on the goroutine that failed, so it
+// should return quickly.
+type ErrorHandler func(event *ErrorEvent)
+
+// newErrorEvent creates the error event of the source that failed on event, which may be just the Flow
+// of a stream.
+func newErrorEvent(source string, event Event, err error, panicked bool) *ErrorEvent {
+	errorEvent := &ErrorEvent{Flow: event.StreamFlow(), Source: source, Err: err, Panicked: panicked}
+
+	switch event := event.(type) {
+	case *HTTPRequestEvent:
+		errorEvent.Request = event.Request
+	case *HTTPResponseEvent:
+		errorEvent.Request = event.Request
+	}
+
+	return errorEvent
+}
+
+// reportError counts the error event and passes it to the error handler, or logs it if there is none.
+func (s *sniffer) reportError(event *ErrorEvent) {
+	atomic.AddUint64(&s.stats.errors, 1)
+
+	if event.Panicked {
+		atomic.AddUint64(&s.stats.panics, 1)
+	}
+
+	if s.errorHandler == nil {
+		log.Printf("error: %s", event)
+
+		return
+	}
+
+	s.errorHandler(event)
+}
+
+// panicError turns a recovered panic into an error, along with the stack of the panic.
+func panicError(recovered interface{}) error {
+	err, ok := recovered.(error)
+	if !ok {
+		err = errors.Errorf("%v", recovered)
+	}
+
+	return errors.WithMessagef(err, "panic\n%s", debug.Stack())
+}
@@ -0,0 +1,119 @@
+package sniff
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+/*
+	contains the events the sniffer emits after decoding reassembled tcp streams
+*/
+
+// Flow identifies the tcp stream an event is decoded from.
+type Flow struct {
+	Net       gopacket.Flow
+	Transport gopacket.Flow
+}
+
+// StreamFlow implements Event.
+func (f Flow) StreamFlow() Flow {
+	return f
+}
+
+// String returns the flow in "src:port->dst:port" form.
+func (f Flow) String() string {
+	return f.Net.Src().String() + ":" + f.Transport.Src().String() + "->" +
+		f.Net.Dst().String() + ":" + f.Transport.Dst().String()
+}
+
+// Event is an application layer message decoded from a reassembled tcp stream, such as an http request
+// or an mqtt packet.
+type Event interface {
+	// StreamFlow returns the tcp stream that the event is decoded from.
+	StreamFlow() Flow
+}
+
+// HTTPRequestEvent is emitted for every http request read from a tcp stream.
+type HTTPRequestEvent struct {
+	Flow
+	Request *http.Request
+}
+
+// HTTPResponseEvent is emitted for every http response read from a tcp stream. Its flow is the
+// direction of the response, from the server to the client.
+type HTTPResponseEvent struct {
+	Flow
+	// Request is the request the response answers. It is nil when the request is not captured.
+	Request  *http.Request
+	Response *http.Response
+	// RequestTime and ResponseTime are the capture times of the first packets of the request and the
+	// response.
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+// Latency returns the time between the request and the response, or 0 if the request is not captured.
+func (e *HTTPResponseEvent) Latency() time.Duration {
+	if e.Request == nil || e.RequestTime.IsZero() || e.ResponseTime.IsZero() {
+		return 0
+	}
+
+	return e.ResponseTime.Sub(e.RequestTime)
+}
+
+// MQTTEvent is emitted for every mqtt control packet read from a tcp stream.
+type MQTTEvent struct {
+	Flow
+	Packet *MQTTPacket
+}
+
+// EventHandler is what the sniffer runs on every decoded event, regardless of the application layer
+// protocol.
+type EventHandler func(ctx context.Context, event Event) error
+
+// isHTTPRequestEvent reports whether the event carries an http request, the only events http request
+// handlers are interested in.
+func isHTTPRequestEvent(event Event) bool {
+	_, ok := event.(*HTTPRequestEvent)
+
+	return ok
+}
+
+// httpEventHandler wraps an http request handler so that it only receives http request events.
+func httpEventHandler(handler Handler) EventHandler {
+	return func(ctx context.Context, event Event) error {
+		httpEvent, ok := event.(*HTTPRequestEvent)
+		if !ok {
+			return nil
+		}
+
+		req := httpEvent.Request
+		req = req.WithContext(context.WithValue(req.Context(), eventKey{}, httpEvent))
+
+		return handler(ctx, req)
+	}
+}
+
+// eventKey is the context key of the event of requests handed to handlers.
+type eventKey struct{}
+
+// RequestEvent returns the event a request handed to a Handler comes from. Its Request is the request
+// as the sniffer decoded it, which is also the Request of the HTTPResponseEvent of its response.
+func RequestEvent(req *http.Request) (*HTTPRequestEvent, bool) {
+	event, ok := req.Context().Value(eventKey{}).(*HTTPRequestEvent)
+
+	return event, ok
+}
+
+// RequestFlow returns the tcp stream a request handed to a Handler is decoded from.
+func RequestFlow(req *http.Request) (Flow, bool) {
+	event, ok := RequestEvent(req)
+	if !ok {
+		return Flow{}, false
+	}
+
+	return event.Flow, true
+}
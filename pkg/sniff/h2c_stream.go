@@ -0,0 +1,202 @@
+package sniff
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+/*
+	contains the decoding of requests sent over cleartext http/2 with prior knowledge (h2c), such as grpc
+	calls between services
+*/
+
+const (
+	// maxH2CStreams is the number of concurrent streams of a connection that are decoded. Further streams
+	// are ignored until earlier ones end.
+	maxH2CStreams = 1024
+	// maxH2CHeaderTableSize is the largest hpack table the decoder accepts. The table size the server
+	// allows is sent in the other direction of the connection, so any reasonable size is accepted.
+	maxH2CHeaderTableSize = 1 << 20
+	// h2FrameHeaderLen is the length of the header of every http/2 frame.
+	h2FrameHeaderLen = 9
+)
+
+// isH2CServer reports whether the stream starts with the settings frame an http/2 server sends first.
+func isH2CServer(buf *bufio.Reader) bool {
+	header, err := buf.Peek(h2FrameHeaderLen)
+	if err != nil {
+		return false
+	}
+
+	return http2.FrameType(header[3]) == http2.FrameSettings &&
+		header[5]&0x7f == 0 && header[6] == 0 && header[7] == 0 && header[8] == 0
+}
+
+// isH2CClient reports whether the stream starts with the connection preface of an http/2 client.
+func isH2CClient(buf *bufio.Reader) bool {
+	preface, err := buf.Peek(len(http2.ClientPreface))
+	return err == nil && string(preface) == http2.ClientPreface
+}
+
+// h2cRequest is a request whose frames are being read.
+type h2cRequest struct {
+	req  *http.Request
+	body bytes.Buffer
+}
+
+// readH2CRequests emits the requests of the streams of an http/2 client connection. Reading stops at the
+// first frame that can not be decoded, since the rest of the connection can not be decoded either.
+func (h *httpStream) readH2CRequests(buf *bufio.Reader) {
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, buf)
+	}()
+
+	if _, err := buf.Discard(len(http2.ClientPreface)); err != nil {
+		return
+	}
+
+	decoder := hpack.NewDecoder(4096, nil)
+	decoder.SetAllowedMaxDynamicTableSize(maxH2CHeaderTableSize)
+
+	framer := http2.NewFramer(nil, buf)
+	framer.ReadMetaHeaders = decoder
+
+	streams := make(map[uint32]*h2cRequest)
+
+	for {
+		frame, err := framer.ReadFrame()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return
+		} else if err != nil {
+			atomic.AddUint64(&h.stats.httpParseErrors, 1)
+
+			return
+		}
+
+		switch frame := frame.(type) {
+		case *http2.MetaHeadersFrame:
+			stream, ok := streams[frame.StreamID]
+			if ok {
+				addH2CTrailers(stream.req, frame)
+			} else {
+				if len(streams) >= maxH2CStreams {
+					continue
+				}
+
+				req, err := newH2CRequest(frame)
+				if err != nil {
+					atomic.AddUint64(&h.stats.httpParseErrors, 1)
+
+					continue
+				}
+
+				stream = &h2cRequest{req: req}
+				streams[frame.StreamID] = stream
+			}
+
+			if frame.StreamEnded() {
+				delete(streams, frame.StreamID)
+				h.emitH2CRequest(stream)
+			}
+		case *http2.DataFrame:
+			stream, ok := streams[frame.StreamID]
+			if !ok {
+				continue
+			}
+
+			stream.body.Write(frame.Data())
+
+			if frame.StreamEnded() {
+				delete(streams, frame.StreamID)
+				h.emitH2CRequest(stream)
+			}
+		case *http2.RSTStreamFrame:
+			delete(streams, frame.StreamID)
+		}
+	}
+}
+
+func (h *httpStream) emitH2CRequest(stream *h2cRequest) {
+	req := stream.req
+	req.RemoteAddr = h.net.Src().String() + ":" + h.transport.Src().String()
+	req.ContentLength = int64(stream.body.Len())
+	setBody(req, stream.body.Bytes())
+
+	h.eventChan <- &HTTPRequestEvent{
+		Flow:    Flow{Net: h.net, Transport: h.transport},
+		Request: req,
+	}
+
+	atomic.AddUint64(&h.stats.requestsEmitted, 1)
+}
+
+// newH2CRequest builds a request from the pseudo and regular header fields of its first headers frame.
+func newH2CRequest(frame *http2.MetaHeadersFrame) (*http.Request, error) {
+	path := frame.PseudoValue("path")
+	if frame.PseudoValue("method") == http.MethodConnect && path == "" {
+		path = "/"
+	}
+
+	u, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method:     frame.PseudoValue("method"),
+		URL:        u,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     make(http.Header),
+		Host:       frame.PseudoValue("authority"),
+		RequestURI: path,
+	}
+
+	var cookies []string
+
+	for _, field := range frame.RegularFields() {
+		// http/2 clients may split cookies into several fields, which http/1.1 joins into one
+		if field.Name == "cookie" {
+			cookies = append(cookies, field.Value)
+
+			continue
+		}
+
+		req.Header.Add(http.CanonicalHeaderKey(field.Name), field.Value)
+	}
+
+	if len(cookies) > 0 {
+		req.Header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+
+	if req.Host == "" {
+		req.Host = req.Header.Get("Host")
+	}
+
+	if length := req.Header.Get("Content-Length"); length != "" {
+		req.ContentLength, _ = strconv.ParseInt(length, 10, 64)
+	}
+
+	return req, nil
+}
+
+// addH2CTrailers adds the fields of a headers frame that follows the data of a request to its trailers.
+func addH2CTrailers(req *http.Request, frame *http2.MetaHeadersFrame) {
+	if req.Trailer == nil {
+		req.Trailer = make(http.Header)
+	}
+
+	for _, field := range frame.RegularFields() {
+		req.Trailer.Add(http.CanonicalHeaderKey(field.Name), field.Value)
+	}
+}
@@ -0,0 +1,547 @@
+package sniff
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/strixeyecom/gniffer/pkg/diskqueue"
+)
+
+/*
+	contains the per handler worker pools that run handlers on decoded events
+*/
+
+// Ordering is the delivery order a handler is guaranteed to see events in.
+type Ordering int
+
+const (
+	// OrderNone hands every event to the first free worker of the handler.
+	OrderNone Ordering = iota
+	// OrderPerConnection hands the events of a tcp connection to the same worker, so they are handled
+	// in the order they are decoded. Events of different connections are still handled concurrently.
+	OrderPerConnection
+	// OrderGlobal handles every event in the order they are decoded. Handlers with global ordering
+	// always run on a single worker.
+	OrderGlobal
+)
+
+// OverflowPolicy decides what happens to new events when the queue of a handler is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits until the handler makes room in its queue, which holds back the tcp reassembly
+	// and every other handler.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the event that does not fit in the queue.
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest queued event to make room for the new one.
+	OverflowDropOldest
+	// OverflowSpill writes the events that do not fit in the queue to a disk backed queue, and feeds them
+	// back to the handler in order once it catches up.
+	OverflowSpill
+)
+
+var overflowPolicyNames = map[OverflowPolicy]string{
+	OverflowBlock:      "block",
+	OverflowDropNewest: "drop-newest",
+	OverflowDropOldest: "drop-oldest",
+	OverflowSpill:      "spill",
+}
+
+func (p OverflowPolicy) String() string {
+	if name, ok := overflowPolicyNames[p]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// ParseOverflowPolicy parses the name of an overflow policy, as returned by OverflowPolicy.String.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	for policy, policyName := range overflowPolicyNames {
+		if strings.EqualFold(name, policyName) {
+			return policy, nil
+		}
+	}
+
+	return OverflowBlock, errors.Errorf("unknown overflow policy \"%s\"", name)
+}
+
+const (
+	defaultConcurrency = 1
+	defaultQueueSize   = 1024
+	// saturationLogInterval is the minimum time between two warnings about the same full queue.
+	saturationLogInterval = time.Second * 10
+	// drainPollInterval is how often drain checks whether the queued events are handled.
+	drainPollInterval = time.Millisecond * 10
+)
+
+// HandlerOption configures how the sniffer runs a handler.
+type HandlerOption func(*handlerOptions)
+
+type handlerOptions struct {
+	name        string
+	concurrency int
+	queueSize   int
+	ordering    Ordering
+	overflow    OverflowPolicy
+	spillDir    string
+	filter      func(event Event) bool
+
+	errorPolicy  ErrorPolicy
+	retries      int
+	retryBackoff time.Duration
+}
+
+// WithName sets the name the handler is reported with in logs and stats. (default: handler-<n>)
+func WithName(name string) HandlerOption {
+	return func(o *handlerOptions) {
+		o.name = name
+	}
+}
+
+// WithConcurrency sets the number of workers that run the handler at the same time. (default: 1)
+func WithConcurrency(concurrency int) HandlerOption {
+	return func(o *handlerOptions) {
+		o.concurrency = concurrency
+	}
+}
+
+// WithQueueSize sets the number of events buffered for the handler before the overflow policy applies.
+// With per connection ordering, every worker has its own queue of this size. (default: 1024)
+func WithQueueSize(queueSize int) HandlerOption {
+	return func(o *handlerOptions) {
+		o.queueSize = queueSize
+	}
+}
+
+// WithOrdering sets the delivery order guarantee of the handler. (default: OrderNone)
+func WithOrdering(ordering Ordering) HandlerOption {
+	return func(o *handlerOptions) {
+		o.ordering = ordering
+	}
+}
+
+// WithOverflowPolicy sets what happens to new events when the queue of the handler is full.
+// (default: OverflowBlock)
+func WithOverflowPolicy(policy OverflowPolicy) HandlerOption {
+	return func(o *handlerOptions) {
+		o.overflow = policy
+	}
+}
+
+// WithSpillDir sets the directory that OverflowSpill writes events to. A temporary directory is created
+// in it for every run and removed when the run ends. (default: os.TempDir())
+func WithSpillDir(dir string) HandlerOption {
+	return func(o *handlerOptions) {
+		o.spillDir = dir
+	}
+}
+
+// WithEventFilter makes the handler receive only the events filter returns true for. The other events
+// are skipped before they are queued, so they never fill the queue of the handler or spill to disk.
+// (default: every event the handler is registered for)
+func WithEventFilter(filter func(event Event) bool) HandlerOption {
+	return func(o *handlerOptions) {
+		o.filter = filter
+	}
+}
+
+// HandlerStats are the counters of a single handler.
+type HandlerStats struct {
+	Name string
+	// Queued is the number of events waiting in memory for the handler.
+	Queued int
+	// Spilled is the number of events written to disk because the queue was full, and SpillQueued is
+	// the number of them still waiting on disk.
+	Spilled     uint64
+	SpillQueued int
+	// Dropped is the number of events the handler never got because of the overflow policy.
+	Dropped uint64
+	// Errors is the number of times the handler returned an error, including the failed retries.
+	Errors uint64
+	// Retries is the number of times the handler ran again for a failed event.
+	Retries uint64
+	// Handled is the number of events the handler finished, successfully or not. AvgLatency and
+	// MaxLatency are the average and the longest time it took to handle an event, including the retries.
+	Handled    uint64
+	AvgLatency time.Duration
+	MaxLatency time.Duration
+}
+
+// eventQueue is a queue of events in memory, optionally backed by a disk queue for overflowing events.
+type eventQueue struct {
+	events chan Event
+	spill  *diskqueue.Queue
+	// spillPending is the number of spilled events that are not moved back to events yet. While it is
+	// not zero, new events are spilled too, so that they do not get ahead of the spilled ones.
+	spillPending int64
+}
+
+// handlerQueue buffers events for a single handler and runs the handler on its own workers, so that a
+// slow handler does not hold back the others or the tcp reassembly.
+type handlerQueue struct {
+	handler EventHandler
+	options handlerOptions
+	// accept skips the events the handler is not interested in before they are queued, if it is not nil.
+	accept func(event Event) bool
+	// report passes the panics of the handler to the error handler of the sniffer.
+	report func(event *ErrorEvent)
+	// queues has a single queue shared by all workers when there is no ordering guarantee, and a queue
+	// per worker otherwise.
+	queues []*eventQueue
+
+	// pending is the number of events queued in memory or on disk, or being handled.
+	pending int64
+	dropped uint64
+	spilled uint64
+	errors  uint64
+	retries uint64
+	handled uint64
+	// latency and maxLatency are the total and the longest handling time of events, in nanoseconds.
+	latency    int64
+	maxLatency int64
+	// lastSaturationLog is the unix nano time of the last warning about a full queue.
+	lastSaturationLog int64
+}
+
+func newHandlerQueue(name string, handler EventHandler, opts ...HandlerOption) *handlerQueue {
+	options := handlerOptions{
+		name:        name,
+		concurrency: defaultConcurrency,
+		queueSize:   defaultQueueSize,
+		ordering:    OrderNone,
+		overflow:    OverflowBlock,
+		spillDir:    os.TempDir(),
+
+		errorPolicy:  ErrorStop,
+		retries:      defaultRetries,
+		retryBackoff: defaultRetryBackoff,
+	}
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if options.concurrency < 1 || options.ordering == OrderGlobal {
+		options.concurrency = 1
+	}
+
+	if options.queueSize < 0 {
+		options.queueSize = 0
+	}
+
+	queueCount := 1
+	if options.ordering == OrderPerConnection {
+		queueCount = options.concurrency
+	}
+
+	q := &handlerQueue{
+		handler: handler,
+		options: options,
+		queues:  make([]*eventQueue, queueCount),
+	}
+
+	for i := range q.queues {
+		q.queues[i] = &eventQueue{events: make(chan Event, options.queueSize)}
+	}
+
+	return q
+}
+
+// start runs the workers of the handler until ctx is done. The first error a worker gets from the
+// handler is passed to fail.
+func (q *handlerQueue) start(ctx context.Context, wg *sync.WaitGroup, fail func(error)) error {
+	if q.options.overflow == OverflowSpill {
+		if err := q.openSpill(ctx, wg); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < q.options.concurrency; i++ {
+		queue := q.queues[i%len(q.queues)]
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			q.work(ctx, queue, fail)
+		}()
+	}
+
+	return nil
+}
+
+func (q *handlerQueue) work(ctx context.Context, queue *eventQueue, fail func(error)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-queue.events:
+			start := time.Now()
+			err := q.handle(ctx, event)
+			q.observe(time.Since(start))
+			atomic.AddInt64(&q.pending, -1)
+
+			if err != nil {
+				fail(err)
+
+				return
+			}
+		}
+	}
+}
+
+// openSpill creates the disk queues of the handler and starts moving spilled events back to memory.
+// The disk queues are removed once ctx is done.
+func (q *handlerQueue) openSpill(ctx context.Context, wg *sync.WaitGroup) error {
+	dir, err := ioutil.TempDir(q.options.spillDir, "gniffer-spill-")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create spill directory for handler %s", q.options.name)
+	}
+
+	for i, queue := range q.queues {
+		queue.spill, err = diskqueue.Open(filepath.Join(dir, strconv.Itoa(i)), 0)
+		if err != nil {
+			_ = os.RemoveAll(dir)
+
+			return errors.Wrapf(err, "failed to open spill queue for handler %s", q.options.name)
+		}
+	}
+
+	var feeders sync.WaitGroup
+
+	for _, queue := range q.queues {
+		feeders.Add(1)
+
+		go func(queue *eventQueue) {
+			defer feeders.Done()
+
+			q.unspill(ctx, queue)
+		}(queue)
+	}
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		feeders.Wait()
+
+		for _, queue := range q.queues {
+			_ = queue.spill.Close()
+		}
+
+		_ = os.RemoveAll(dir)
+	}()
+
+	return nil
+}
+
+// unspill moves spilled events back to the in memory queue in the order they are spilled.
+func (q *handlerQueue) unspill(ctx context.Context, queue *eventQueue) {
+	for {
+		raw, ok, err := queue.spill.Pop()
+		if err != nil {
+			log.Printf("handler %s: failed to read spilled event: %s", q.options.name, err)
+
+			return
+		}
+
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-queue.spill.Pushed():
+				continue
+			}
+		}
+
+		event, err := decodeEvent(raw)
+		if err != nil {
+			atomic.AddUint64(&q.dropped, 1)
+			atomic.AddInt64(&queue.spillPending, -1)
+			atomic.AddInt64(&q.pending, -1)
+
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case queue.events <- event:
+			atomic.AddInt64(&queue.spillPending, -1)
+		}
+	}
+}
+
+// push queues the event for the handler, applying the overflow policy if the queue is full. It returns
+// false if ctx is done before the event could be queued.
+func (q *handlerQueue) push(ctx context.Context, event Event) bool {
+	if q.accept != nil && !q.accept(event) {
+		return true
+	}
+
+	queue := q.queueOf(event)
+
+	if q.options.overflow == OverflowSpill && atomic.LoadInt64(&queue.spillPending) > 0 {
+		q.spill(queue, event)
+
+		return true
+	}
+
+	select {
+	case queue.events <- event:
+		atomic.AddInt64(&q.pending, 1)
+
+		return true
+	default:
+	}
+
+	q.logSaturation()
+
+	switch q.options.overflow {
+	case OverflowDropNewest:
+		atomic.AddUint64(&q.dropped, 1)
+
+		return true
+	case OverflowDropOldest:
+		for {
+			select {
+			case queue.events <- event:
+				atomic.AddInt64(&q.pending, 1)
+
+				return true
+			case <-queue.events:
+				atomic.AddUint64(&q.dropped, 1)
+				atomic.AddInt64(&q.pending, -1)
+			}
+		}
+	case OverflowSpill:
+		q.spill(queue, event)
+
+		return true
+	case OverflowBlock:
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case queue.events <- event:
+		atomic.AddInt64(&q.pending, 1)
+
+		return true
+	}
+}
+
+// drain waits until every queued event is handled. It returns early if ctx is done.
+func (q *handlerQueue) drain(ctx context.Context) {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&q.pending) > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *handlerQueue) spill(queue *eventQueue, event Event) {
+	// counted before the push, unspill may pop the event and count it out before Push returns. Counting
+	// it after would let a concurrent push see no pending spilled events and get ahead of this one.
+	atomic.AddInt64(&queue.spillPending, 1)
+	atomic.AddInt64(&q.pending, 1)
+
+	raw, err := encodeEvent(event)
+	if err == nil {
+		err = queue.spill.Push(raw)
+	}
+
+	if err != nil {
+		log.Printf("handler %s: failed to spill event: %s", q.options.name, err)
+		atomic.AddInt64(&queue.spillPending, -1)
+		atomic.AddInt64(&q.pending, -1)
+		atomic.AddUint64(&q.dropped, 1)
+
+		return
+	}
+
+	atomic.AddUint64(&q.spilled, 1)
+}
+
+// logSaturation warns that the queue of the handler is full, at most once in saturationLogInterval.
+func (q *handlerQueue) logSaturation() {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&q.lastSaturationLog)
+
+	if now-last < int64(saturationLogInterval) ||
+		!atomic.CompareAndSwapInt64(&q.lastSaturationLog, last, now) {
+		return
+	}
+
+	log.Printf(
+		"handler %s: queue is full, applying %s overflow policy (dropped %d, spilled %d so far)",
+		q.options.name, q.options.overflow, atomic.LoadUint64(&q.dropped), atomic.LoadUint64(&q.spilled),
+	)
+}
+
+// observe records the handling time of an event.
+func (q *handlerQueue) observe(latency time.Duration) {
+	atomic.AddUint64(&q.handled, 1)
+	atomic.AddInt64(&q.latency, int64(latency))
+
+	for {
+		longest := atomic.LoadInt64(&q.maxLatency)
+		if int64(latency) <= longest || atomic.CompareAndSwapInt64(&q.maxLatency, longest, int64(latency)) {
+			return
+		}
+	}
+}
+
+func (q *handlerQueue) queueOf(event Event) *eventQueue {
+	if len(q.queues) == 1 {
+		return q.queues[0]
+	}
+
+	flow := event.StreamFlow()
+	// both flow hashes are symmetric, so both directions of a connection end up in the same queue.
+	hash := flow.Net.FastHash()*31 + flow.Transport.FastHash()
+
+	return q.queues[hash%uint64(len(q.queues))]
+}
+
+func (q *handlerQueue) stats() HandlerStats {
+	stats := HandlerStats{
+		Name:    q.options.name,
+		Spilled: atomic.LoadUint64(&q.spilled),
+		Dropped: atomic.LoadUint64(&q.dropped),
+		Errors:  atomic.LoadUint64(&q.errors),
+		Retries: atomic.LoadUint64(&q.retries),
+		Handled: atomic.LoadUint64(&q.handled),
+
+		MaxLatency: time.Duration(atomic.LoadInt64(&q.maxLatency)),
+	}
+
+	if stats.Handled > 0 {
+		stats.AvgLatency = time.Duration(atomic.LoadInt64(&q.latency) / int64(stats.Handled))
+	}
+
+	for _, queue := range q.queues {
+		stats.Queued += len(queue.events)
+		stats.SpillQueued += int(atomic.LoadInt64(&queue.spillPending))
+	}
+
+	return stats
+}
@@ -0,0 +1,145 @@
+package sniff
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	contains what the sniffer does when a handler returns an error
+*/
+
+// ErrorPolicy decides what happens when a handler returns an error.
+type ErrorPolicy int
+
+const (
+	// ErrorStop stops the sniffer, and Run returns the error.
+	ErrorStop ErrorPolicy = iota
+	// ErrorIgnore drops the event silently.
+	ErrorIgnore
+	// ErrorLog logs the error and drops the event.
+	ErrorLog
+	// ErrorRetry runs the handler again with exponential backoff, and logs the error if the event still
+	// fails after the last attempt.
+	ErrorRetry
+)
+
+var errorPolicyNames = map[ErrorPolicy]string{
+	ErrorStop:   "stop",
+	ErrorIgnore: "ignore",
+	ErrorLog:    "log",
+	ErrorRetry:  "retry",
+}
+
+func (p ErrorPolicy) String() string {
+	if name, ok := errorPolicyNames[p]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// ParseErrorPolicy parses the name of an error policy, as returned by ErrorPolicy.String.
+func ParseErrorPolicy(name string) (ErrorPolicy, error) {
+	for policy, policyName := range errorPolicyNames {
+		if strings.EqualFold(name, policyName) {
+			return policy, nil
+		}
+	}
+
+	return ErrorStop, errors.Errorf("unknown error policy \"%s\"", name)
+}
+
+const (
+	defaultRetries      = 3
+	defaultRetryBackoff = time.Millisecond * 100
+)
+
+// WithErrorPolicy sets what happens when the handler returns an error. (default: ErrorStop)
+func WithErrorPolicy(policy ErrorPolicy) HandlerOption {
+	return func(o *handlerOptions) {
+		o.errorPolicy = policy
+	}
+}
+
+// WithRetry sets the ErrorRetry policy, which retries a failed event up to retries times. The first
+// retry waits for backoff, and every following one waits twice as long as the previous.
+// (default: 3 retries, 100ms backoff)
+func WithRetry(retries int, backoff time.Duration) HandlerOption {
+	return func(o *handlerOptions) {
+		o.errorPolicy = ErrorRetry
+		o.retries = retries
+		o.retryBackoff = backoff
+	}
+}
+
+// handle runs the handler on the event and applies the error policy. It only returns an error when the
+// sniffer should stop.
+func (q *handlerQueue) handle(ctx context.Context, event Event) error {
+	err := q.call(event)
+	if err == nil {
+		return nil
+	}
+
+	atomic.AddUint64(&q.errors, 1)
+
+	switch q.options.errorPolicy {
+	case ErrorStop:
+		return errors.WithMessagef(err, "handler %s failed", q.options.name)
+	case ErrorIgnore:
+	case ErrorLog:
+		log.Printf("handler %s: %s", q.options.name, err)
+	case ErrorRetry:
+		q.retry(ctx, event, err)
+	}
+
+	return nil
+}
+
+func (q *handlerQueue) retry(ctx context.Context, event Event, err error) {
+	backoff := q.options.retryBackoff
+
+	for attempt := 0; attempt < q.options.retries; attempt++ {
+		timer := time.NewTimer(backoff)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return
+		case <-timer.C:
+		}
+
+		atomic.AddUint64(&q.retries, 1)
+
+		if err = q.call(event); err == nil {
+			return
+		}
+
+		atomic.AddUint64(&q.errors, 1)
+
+		backoff *= 2
+	}
+
+	log.Printf("handler %s: giving up after %d retries: %s", q.options.name, q.options.retries, err)
+}
+
+// call runs the handler on the event. A panic of the handler is reported as an error event instead of
+// crashing the sniffer, and the event is not retried.
+func (q *handlerQueue) call(event Event) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			atomic.AddUint64(&q.errors, 1)
+			q.report(newErrorEvent("handler "+q.options.name, event, panicError(recovered), true))
+
+			err = nil
+		}
+	}()
+
+	return q.handler(context.Background(), event)
+}
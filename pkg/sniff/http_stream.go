@@ -5,10 +5,14 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
 	"github.com/google/gopacket/tcpassembly/tcpreader"
 )
 
@@ -16,36 +20,355 @@ import (
 	Created by aomerk at 2021-11-23 for project strixeye
 */
 // global constants for file.
-const ()
+const (
+	// maxPendingRequests is the number of requests of a connection that wait for their responses. Older
+	// ones are forgotten, for connections whose responses are not captured.
+	maxPendingRequests = 64
+	// responseMatchTimeout is how long a response waits for its request to be decoded by the other
+	// direction of the connection.
+	responseMatchTimeout = time.Millisecond * 100
+)
 
 // httpStream will handleProfiling the actual decoding of http requests.
 type httpStream struct {
 	net, transport gopacket.Flow
-	r              tcpreader.ReaderStream
-	requestChan    chan *http.Request
+	r              timedStream
+	conn           *httpConn
+	eventChan      chan Event
+	stats          *pipelineStats
+	report         func(event *ErrorEvent)
+}
+
+// pendingRequest is a decoded request that waits for its response.
+type pendingRequest struct {
+	req  *http.Request
+	seen time.Time
+}
+
+// httpConn is shared by both directions of an http connection, so that responses are matched to the
+// requests they answer. http/1.1 responses come in the order of the requests, so the nth response of a
+// connection answers its nth request.
+type httpConn struct {
+	mu sync.Mutex
+	// pending are the decoded requests waiting for their responses, by sequence number. requests and
+	// responses are the sequence numbers of the next request and response, and requests before missed
+	// are decoded after their responses gave up waiting for them.
+	pending   map[uint64]pendingRequest
+	requests  uint64
+	responses uint64
+	missed    uint64
+	// decoded is closed and replaced when a request is pushed, to wake up a response waiting for it.
+	decoded chan struct{}
+}
+
+func (c *httpConn) push(request pendingRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seq := c.requests
+	c.requests++
+
+	// a response that gave up waiting for the request is emitted without it already
+	if seq >= c.missed {
+		if c.pending == nil {
+			c.pending = make(map[uint64]pendingRequest)
+		}
+
+		c.pending[seq] = request
+
+		// forget the oldest request, for connections whose responses are not captured
+		if seq >= maxPendingRequests {
+			delete(c.pending, seq-maxPendingRequests)
+		}
+	}
+
+	if c.decoded != nil {
+		close(c.decoded)
+		c.decoded = nil
+	}
+}
+
+// next returns the request the next response answers, waiting up to responseMatchTimeout for it to be
+// decoded. It reports false if the request is not decoded in time, or if it is forgotten. The request is
+// taken by answered once the response is decoded, so that bytes that fail to decode as a response do not
+// take the request of the response after them.
+func (c *httpConn) next() (pendingRequest, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seq := c.responses
+
+	if seq >= c.requests {
+		timer := time.NewTimer(responseMatchTimeout)
+		defer timer.Stop()
+
+		for seq >= c.requests {
+			if c.decoded == nil {
+				c.decoded = make(chan struct{})
+			}
+
+			decoded := c.decoded
+			c.mu.Unlock()
+
+			select {
+			case <-decoded:
+				c.mu.Lock()
+			case <-timer.C:
+				c.mu.Lock()
+
+				return pendingRequest{}, false
+			}
+		}
+	}
+
+	request, ok := c.pending[seq]
+
+	return request, ok
+}
+
+// answered takes the request of the response that is decoded.
+func (c *httpConn) answered() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seq := c.responses
+	c.responses++
+
+	// the response is emitted without its request, which is forgotten when it is decoded
+	if seq >= c.requests {
+		c.missed = seq + 1
+	}
+
+	delete(c.pending, seq)
 }
 
 func (h *httpStream) run() {
 	defer func() {
-		dErr := recover()
-		if dErr != nil {
-			log.Fatal(dErr.(error))
+		if recovered := recover(); recovered != nil {
+			flow := Flow{Net: h.net, Transport: h.transport}
+			h.report(newErrorEvent("http stream", flow, panicError(recovered), true))
+			// the rest of the stream is lost, but it must still be read until EOF.
+			h.r.stopTiming()
+			_, _ = io.Copy(ioutil.Discard, &h.r)
 		}
 	}()
 	buf := bufio.NewReader(&h.r)
+
+	// servers speak first with the protocol version, clients with the method. http/2 clients start with
+	// the connection preface, and servers with a settings frame.
+	if prefix, err := buf.Peek(len("HTTP/")); err == nil && string(prefix) == "HTTP/" {
+		h.readResponses(buf)
+
+		return
+	}
+
+	switch {
+	case isH2CClient(buf):
+		// h2c requests are not paired with responses, so they are not timed
+		h.r.stopTiming()
+		h.readH2CRequests(buf)
+	case isH2CServer(buf):
+		// responses of h2c connections are not decoded
+		h.r.stopTiming()
+		_, _ = io.Copy(ioutil.Discard, buf)
+	default:
+		h.readRequests(buf)
+	}
+}
+
+func (h *httpStream) readRequests(buf *bufio.Reader) {
 	for {
+		offset := h.r.offset(buf)
+		h.r.forget(offset)
+
 		req, err := http.ReadRequest(buf)
 		if err == io.EOF {
 			// We must read until we see an EOF... very important!
 			return
 		} else if err != nil {
+			atomic.AddUint64(&h.stats.httpParseErrors, 1)
+
 			continue
 		} else {
 			req.RemoteAddr = h.net.Src().String() + ":" + h.transport.Src().String()
 			// body is a tricky mistress. To guarantee we don't lose it, just a trick to be safe
 			body, _ := ioutil.ReadAll(req.Body)
-			req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-			h.requestChan <- req
+			setBody(req, body)
+
+			h.conn.push(pendingRequest{req: req, seen: h.r.seenAt(offset)})
+
+			h.eventChan <- &HTTPRequestEvent{
+				Flow:    Flow{Net: h.net, Transport: h.transport},
+				Request: req,
+			}
+
+			atomic.AddUint64(&h.stats.requestsEmitted, 1)
 		}
 	}
 }
+
+func (h *httpStream) readResponses(buf *bufio.Reader) {
+	for {
+		if _, err := buf.Peek(1); err == io.EOF {
+			return
+		}
+
+		offset := h.r.offset(buf)
+		h.r.forget(offset)
+
+		request, _ := h.conn.next()
+
+		resp, err := http.ReadResponse(buf, request.req)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			atomic.AddUint64(&h.stats.httpParseErrors, 1)
+
+			continue
+		}
+
+		h.conn.answered()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body = newBytesBody(body)
+
+		h.eventChan <- &HTTPResponseEvent{
+			Flow:         Flow{Net: h.net, Transport: h.transport},
+			Request:      request.req,
+			Response:     resp,
+			RequestTime:  request.seen,
+			ResponseTime: h.r.seenAt(offset),
+		}
+
+		atomic.AddUint64(&h.stats.responsesEmitted, 1)
+	}
+}
+
+// setBody sets the body of a decoded request, along with GetBody so that the body can be read again
+// without consuming it.
+func setBody(req *http.Request, body []byte) {
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+// bytesBody is a decoded response body, which keeps its bytes so that the response can be encoded again
+// without consuming the body.
+type bytesBody struct {
+	*bytes.Reader
+	raw []byte
+}
+
+func newBytesBody(raw []byte) *bytesBody {
+	return &bytesBody{Reader: bytes.NewReader(raw), raw: raw}
+}
+
+// ResponseBody returns the body of a response decoded by the sniffer without reading it, so that every
+// handler of the response can get the whole body. Other responses are read.
+func ResponseBody(resp *http.Response) ([]byte, error) {
+	if body, ok := resp.Body.(*bytesBody); ok {
+		return body.raw, nil
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (b *bytesBody) Close() error {
+	return nil
+}
+
+// seenMark is the capture time of the bytes of a stream starting at offset.
+type seenMark struct {
+	offset int64
+	seen   time.Time
+}
+
+// timedStream is a reader stream that remembers when its bytes are captured, so that decoded messages
+// can be timed by their first packet.
+type timedStream struct {
+	tcpreader.ReaderStream
+
+	mu       sync.Mutex
+	marks    []seenMark
+	received int64
+	// untimed streams do not remember when their bytes are captured.
+	untimed bool
+	// read is the number of bytes read from the stream, only used by the reading goroutine.
+	read int64
+}
+
+// Reassembled implements tcpassembly.Stream.
+func (t *timedStream) Reassembled(reassembly []tcpassembly.Reassembly) {
+	t.mu.Lock()
+	for _, r := range reassembly {
+		if len(r.Bytes) == 0 || t.untimed {
+			continue
+		}
+
+		t.marks = append(t.marks, seenMark{offset: t.received, seen: r.Seen})
+		t.received += int64(len(r.Bytes))
+	}
+	t.mu.Unlock()
+
+	t.ReaderStream.Reassembled(reassembly)
+}
+
+func (t *timedStream) Read(p []byte) (int, error) {
+	n, err := t.ReaderStream.Read(p)
+	t.read += int64(n)
+
+	return n, err
+}
+
+// offset is the position of the next byte buf will return.
+func (t *timedStream) offset(buf *bufio.Reader) int64 {
+	return t.read - int64(buf.Buffered())
+}
+
+// seenAt returns the capture time of the byte at offset, and forgets the times of the earlier bytes.
+func (t *timedStream) seenAt(offset int64) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := t.markOf(offset)
+	if i < 0 {
+		return time.Time{}
+	}
+
+	seen := t.marks[i].seen
+	t.marks = t.marks[i:]
+
+	return seen
+}
+
+// forget forgets the capture times of the bytes before offset, which are not asked for anymore. Streams
+// call it for every message they start to decode, so that the times of bytes that do not decode are not
+// kept for the lifetime of the connection.
+func (t *timedStream) forget(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if i := t.markOf(offset); i > 0 {
+		t.marks = t.marks[i:]
+	}
+}
+
+// stopTiming forgets the capture times of the stream, and stops remembering them.
+func (t *timedStream) stopTiming() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.untimed = true
+	t.marks = nil
+}
+
+// markOf returns the index of the mark of the byte at offset, -1 if there is none. It must be called with
+// the lock held.
+func (t *timedStream) markOf(offset int64) int {
+	return sort.Search(
+		len(t.marks), func(i int) bool {
+			return t.marks[i].offset > offset
+		},
+	) - 1
+}
@@ -0,0 +1,144 @@
+package sniff
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+/*
+	contains middlewares to build request handling pipelines out of reusable stages
+*/
+
+// Redacted is what Redact replaces sensitive values with.
+const Redacted = "[REDACTED]"
+
+// Middleware wraps a handler to filter, transform or observe requests before they reach it.
+type Middleware func(next Handler) Handler
+
+// Chain wraps handler with middlewares. The first middleware sees the request first.
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
+
+// Filter passes only the requests that match to the next handler.
+func Filter(match func(req *http.Request) bool) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, req *http.Request) error {
+			if !match(req) {
+				return nil
+			}
+
+			return next(ctx, req)
+		}
+	}
+}
+
+// Sample passes a random rate of the requests to the next handler, where rate is between 0 and 1.
+func Sample(rate float64) Middleware {
+	return Filter(
+		func(req *http.Request) bool {
+			return rate >= 1 || rand.Float64() < rate // nolint:gosec // sampling does not need crypto rand
+		},
+	)
+}
+
+// Enrich runs enrich on a copy of every request, so that it can add headers or context values without
+// changing the request other handlers see.
+func Enrich(enrich func(req *http.Request) *http.Request) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, req *http.Request) error {
+			dup, err := cloneRequest(ctx, req)
+			if err != nil {
+				return err
+			}
+
+			return next(ctx, enrich(dup))
+		}
+	}
+}
+
+// Redaction lists the sensitive parts of a request that Redact hides. Header and cookie names are case
+// insensitive, query parameter names are not.
+type Redaction struct {
+	Headers     []string
+	Cookies     []string
+	QueryParams []string
+}
+
+// Redact replaces the values listed in redaction with Redacted, on a copy of every request.
+func Redact(redaction Redaction) Middleware {
+	return Enrich(
+		func(req *http.Request) *http.Request {
+			for _, name := range redaction.Headers {
+				if values := req.Header.Values(name); len(values) > 0 {
+					req.Header.Del(name)
+
+					for range values {
+						req.Header.Add(name, Redacted)
+					}
+				}
+			}
+
+			if len(redaction.Cookies) > 0 {
+				redactCookies(req, redaction.Cookies)
+			}
+
+			if len(redaction.QueryParams) > 0 {
+				query := req.URL.Query()
+				for _, name := range redaction.QueryParams {
+					if values, ok := query[name]; ok {
+						for i := range values {
+							values[i] = Redacted
+						}
+					}
+				}
+
+				req.URL.RawQuery = query.Encode()
+				req.RequestURI = req.URL.RequestURI()
+			}
+
+			return req
+		},
+	)
+}
+
+func redactCookies(req *http.Request, names []string) {
+	cookies := req.Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+
+	req.Header.Del("Cookie")
+
+	for _, cookie := range cookies {
+		for _, name := range names {
+			if strings.EqualFold(cookie.Name, name) {
+				cookie.Value = Redacted
+			}
+		}
+
+		req.AddCookie(cookie)
+	}
+}
+
+// cloneRequest deep copies the request, including a fresh reader of the body.
+func cloneRequest(ctx context.Context, req *http.Request) (*http.Request, error) {
+	dup := req.Clone(ctx)
+
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+
+		dup.Body = body
+	}
+
+	return dup, nil
+}
@@ -0,0 +1,640 @@
+package sniff
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	contains mqtt 3.1.1 and 5.0 control packet decoding
+*/
+
+// MQTTPacketType is the control packet type from the mqtt fixed header.
+type MQTTPacketType byte
+
+// mqtt control packet types.
+const (
+	MQTTConnect     MQTTPacketType = 1
+	MQTTConnAck     MQTTPacketType = 2
+	MQTTPublish     MQTTPacketType = 3
+	MQTTPubAck      MQTTPacketType = 4
+	MQTTPubRec      MQTTPacketType = 5
+	MQTTPubRel      MQTTPacketType = 6
+	MQTTPubComp     MQTTPacketType = 7
+	MQTTSubscribe   MQTTPacketType = 8
+	MQTTSubAck      MQTTPacketType = 9
+	MQTTUnsubscribe MQTTPacketType = 10
+	MQTTUnsubAck    MQTTPacketType = 11
+	MQTTPingReq     MQTTPacketType = 12
+	MQTTPingResp    MQTTPacketType = 13
+	MQTTDisconnect  MQTTPacketType = 14
+	MQTTAuth        MQTTPacketType = 15
+)
+
+// mqtt protocol levels as they appear in the connect packet.
+const (
+	MQTTVersion31  byte = 3
+	MQTTVersion311 byte = 4
+	MQTTVersion5   byte = 5
+)
+
+// maxMQTTRemainingLength is the largest value the variable byte integer of the fixed header can hold.
+const maxMQTTRemainingLength = 268435455
+
+// mqtt 5.0 property value encodings.
+const (
+	mqttPropByte = iota + 1
+	mqttPropUint16
+	mqttPropUint32
+	mqttPropVarInt
+	mqttPropString
+	mqttPropStringPair
+)
+
+// mqttPacketProperties are the encodings of the properties that packets with a version dependent layout
+// may carry, by property identifier. They tell mqtt 5.0 packets from 3.1.1 ones when the connect packet
+// of the connection was not captured.
+var mqttPacketProperties = map[MQTTPacketType]map[byte]int{
+	MQTTPublish: {
+		0x01: mqttPropByte, 0x02: mqttPropUint32, 0x03: mqttPropString, 0x08: mqttPropString,
+		0x09: mqttPropString, 0x0b: mqttPropVarInt, 0x23: mqttPropUint16, 0x26: mqttPropStringPair,
+	},
+	MQTTSubscribe:   {0x0b: mqttPropVarInt, 0x26: mqttPropStringPair},
+	MQTTUnsubscribe: {0x26: mqttPropStringPair},
+	MQTTSubAck:      {0x1f: mqttPropString, 0x26: mqttPropStringPair},
+}
+
+// valid suback return codes of mqtt 3.1.1 and reason codes of mqtt 5.0.
+var (
+	mqtt311SubAckCodes = map[byte]bool{0x00: true, 0x01: true, 0x02: true, 0x80: true}
+	mqtt5SubAckCodes   = map[byte]bool{
+		0x00: true, 0x01: true, 0x02: true, 0x80: true, 0x83: true, 0x87: true,
+		0x8f: true, 0x91: true, 0x97: true, 0x9e: true, 0xa1: true, 0xa2: true,
+	}
+)
+
+var mqttPacketTypeNames = map[MQTTPacketType]string{
+	MQTTConnect:     "CONNECT",
+	MQTTConnAck:     "CONNACK",
+	MQTTPublish:     "PUBLISH",
+	MQTTPubAck:      "PUBACK",
+	MQTTPubRec:      "PUBREC",
+	MQTTPubRel:      "PUBREL",
+	MQTTPubComp:     "PUBCOMP",
+	MQTTSubscribe:   "SUBSCRIBE",
+	MQTTSubAck:      "SUBACK",
+	MQTTUnsubscribe: "UNSUBSCRIBE",
+	MQTTUnsubAck:    "UNSUBACK",
+	MQTTPingReq:     "PINGREQ",
+	MQTTPingResp:    "PINGRESP",
+	MQTTDisconnect:  "DISCONNECT",
+	MQTTAuth:        "AUTH",
+}
+
+func (t MQTTPacketType) String() string {
+	if name, ok := mqttPacketTypeNames[t]; ok {
+		return name
+	}
+
+	return "UNKNOWN"
+}
+
+// MQTTSubscription is a single topic filter of a subscribe or unsubscribe packet.
+type MQTTSubscription struct {
+	Topic string
+	// QoS is the requested maximum qos, always zero for unsubscribe packets.
+	QoS byte
+}
+
+// MQTTPacket is a decoded mqtt control packet. Only the fields relevant to Type are set.
+type MQTTPacket struct {
+	Type MQTTPacketType
+	// ProtocolVersion is the protocol level negotiated in the connect packet of the connection, or the
+	// version the layout of the packets fits when the connect packet was not captured.
+	ProtocolVersion byte
+	// PacketID is set for publish (qos > 0), subscribe, unsubscribe and their acknowledgements.
+	PacketID uint16
+
+	// ClientID, Username, KeepAlive and CleanSession are set for connect packets.
+	ClientID     string
+	Username     string
+	KeepAlive    uint16
+	CleanSession bool
+
+	// Topic, QoS, Retain, Dup and Payload are set for publish packets.
+	Topic   string
+	QoS     byte
+	Retain  bool
+	Dup     bool
+	Payload []byte
+
+	// Subscriptions is set for subscribe and unsubscribe packets.
+	Subscriptions []MQTTSubscription
+
+	// SessionPresent is set for connack packets.
+	SessionPresent bool
+	// ReasonCodes holds the connack return code, the suback return codes and, for mqtt 5.0,
+	// the reason codes of the other acknowledgement packets.
+	ReasonCodes []byte
+}
+
+// readMQTTPacket reads a single control packet from r. version is the protocol level of the connection,
+// zero if it is not known yet. It returns errMQTTUnknownVersion for a packet that is read completely but
+// can not be decoded without the version, so that the packets after it can still be read.
+func readMQTTPacket(r *bufio.Reader, version byte) (*MQTTPacket, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	packetType := MQTTPacketType(first >> 4)
+	if packetType == 0 {
+		return nil, errors.New("reserved mqtt packet type")
+	}
+
+	length, err := readMQTTVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// read through a limited reader so that a bogus length does not allocate the whole buffer upfront
+	body, err := ioutil.ReadAll(io.LimitReader(r, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) < length {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	packet := &MQTTPacket{Type: packetType, ProtocolVersion: version}
+	d := &mqttDecoder{buf: body}
+
+	switch packetType {
+	case MQTTConnect:
+		err = d.connect(packet)
+	case MQTTConnAck:
+		err = d.connAck(packet)
+	case MQTTPublish:
+		err = d.decode(packet, func(d *mqttDecoder, packet *MQTTPacket) error {
+			return d.publish(packet, first&0x0f)
+		})
+	case MQTTPubAck, MQTTPubRec, MQTTPubRel, MQTTPubComp, MQTTUnsubAck:
+		err = d.ack(packet)
+	case MQTTSubscribe, MQTTUnsubscribe:
+		err = d.decode(packet, (*mqttDecoder).subscribe)
+	case MQTTSubAck:
+		err = d.decode(packet, (*mqttDecoder).subAck)
+	case MQTTDisconnect, MQTTAuth:
+		if len(body) > 0 {
+			packet.ProtocolVersion = MQTTVersion5
+			packet.ReasonCodes = body[:1]
+		}
+	case MQTTPingReq, MQTTPingResp:
+	}
+
+	if err != nil {
+		return nil, errors.WithMessagef(err, "malformed mqtt %s packet", packetType)
+	}
+
+	return packet, nil
+}
+
+func readMQTTVarInt(r io.ByteReader) (int, error) {
+	var value, multiplier = 0, 1
+
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		value += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			return value, nil
+		}
+
+		multiplier *= 128
+	}
+
+	return 0, errors.Errorf("mqtt remaining length exceeds %d", maxMQTTRemainingLength)
+}
+
+var (
+	errMQTTShortPacket    = errors.New("packet is shorter than its fields")
+	errMQTTInvalidField   = errors.New("packet has a field that is not valid for its protocol version")
+	errMQTTUnknownVersion = errors.New("packet fits the layouts of both or neither protocol version, " +
+		"and the connect packet of the connection is not captured")
+)
+
+// mqttDecoder reads the variable header and payload fields of a control packet.
+type mqttDecoder struct {
+	buf []byte
+	// strict rejects values that the layout can hold but the protocol does not allow, while the protocol
+	// version of a packet is being guessed.
+	strict bool
+}
+
+// decode decodes the fields of a packet whose layout depends on the protocol version. If the version of
+// the connection is not known, the packet is decoded with the layouts of both mqtt 3.1.1 and 5.0, and it
+// is decoded only if it fits exactly one of them.
+func (d *mqttDecoder) decode(packet *MQTTPacket, fields func(*mqttDecoder, *MQTTPacket) error) error {
+	if packet.ProtocolVersion != 0 {
+		return fields(d, packet)
+	}
+
+	v311, v5 := *packet, *packet
+	v311.ProtocolVersion, v5.ProtocolVersion = MQTTVersion311, MQTTVersion5
+
+	err311 := fields(&mqttDecoder{buf: d.buf, strict: true}, &v311)
+	err5 := fields(&mqttDecoder{buf: d.buf, strict: true}, &v5)
+
+	switch {
+	case err311 == nil && err5 != nil:
+		*packet = v311
+	case err5 == nil && err311 != nil:
+		*packet = v5
+	default:
+		return errMQTTUnknownVersion
+	}
+
+	return nil
+}
+
+// ReadByte implements io.ByteReader so that variable byte integers can be read from the packet.
+func (d *mqttDecoder) ReadByte() (byte, error) {
+	if len(d.buf) < 1 {
+		return 0, errMQTTShortPacket
+	}
+
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+
+	return b, nil
+}
+
+func (d *mqttDecoder) readUint16() (uint16, error) {
+	if len(d.buf) < 2 {
+		return 0, errMQTTShortPacket
+	}
+
+	v := binary.BigEndian.Uint16(d.buf)
+	d.buf = d.buf[2:]
+
+	return v, nil
+}
+
+func (d *mqttDecoder) readBinary() ([]byte, error) {
+	length, err := d.readUint16()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(d.buf) < int(length) {
+		return nil, errMQTTShortPacket
+	}
+
+	v := d.buf[:length]
+	d.buf = d.buf[length:]
+
+	return v, nil
+}
+
+func (d *mqttDecoder) readString() (string, error) {
+	v, err := d.readBinary()
+
+	return string(v), err
+}
+
+// skipProperties skips the mqtt 5.0 property list, whose contents gniffer does not decode. A strict
+// decoder checks that the list holds properties of packetType.
+func (d *mqttDecoder) skipProperties(packetType MQTTPacketType) error {
+	length, err := readMQTTVarInt(d)
+	if err != nil {
+		return err
+	}
+
+	if len(d.buf) < length {
+		return errMQTTShortPacket
+	}
+
+	if d.strict && !validMQTTProperties(packetType, d.buf[:length]) {
+		return errMQTTInvalidField
+	}
+
+	d.buf = d.buf[length:]
+
+	return nil
+}
+
+// validMQTTProperties reports whether props is a list of properties packetType may carry.
+func validMQTTProperties(packetType MQTTPacketType, props []byte) bool {
+	kinds := mqttPacketProperties[packetType]
+	d := &mqttDecoder{buf: props}
+
+	for len(d.buf) > 0 {
+		id, _ := d.ReadByte()
+
+		var err error
+
+		switch kinds[id] {
+		case mqttPropByte:
+			_, err = d.ReadByte()
+		case mqttPropUint16:
+			_, err = d.readUint16()
+		case mqttPropUint32:
+			if _, err = d.readUint16(); err == nil {
+				_, err = d.readUint16()
+			}
+		case mqttPropVarInt:
+			_, err = readMQTTVarInt(d)
+		case mqttPropString:
+			_, err = d.readBinary()
+		case mqttPropStringPair:
+			if _, err = d.readBinary(); err == nil {
+				_, err = d.readBinary()
+			}
+		default:
+			return false
+		}
+
+		if err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validTopic reports whether a strict decoder accepts topic. Only mqtt 5.0 publish packets may have an
+// empty topic, which is replaced by a topic alias.
+func (d *mqttDecoder) validTopic(packet *MQTTPacket, topic string) bool {
+	if !d.strict {
+		return true
+	}
+
+	if topic == "" {
+		return packet.Type == MQTTPublish && packet.ProtocolVersion == MQTTVersion5
+	}
+
+	if packet.Type == MQTTPublish && strings.ContainsAny(topic, "+#") {
+		return false
+	}
+
+	return utf8.ValidString(topic) && !strings.ContainsRune(topic, 0)
+}
+
+func (d *mqttDecoder) connect(packet *MQTTPacket) error {
+	if _, err := d.readString(); err != nil {
+		return err
+	}
+
+	version, err := d.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	packet.ProtocolVersion = version
+
+	flags, err := d.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	packet.CleanSession = flags&0x02 != 0
+
+	if packet.KeepAlive, err = d.readUint16(); err != nil {
+		return err
+	}
+
+	if version == MQTTVersion5 {
+		if err := d.skipProperties(MQTTConnect); err != nil {
+			return err
+		}
+	}
+
+	if packet.ClientID, err = d.readString(); err != nil {
+		return err
+	}
+
+	// will flag
+	if flags&0x04 != 0 {
+		if version == MQTTVersion5 {
+			if err := d.skipProperties(MQTTConnect); err != nil {
+				return err
+			}
+		}
+
+		if _, err := d.readString(); err != nil {
+			return err
+		}
+
+		if _, err := d.readBinary(); err != nil {
+			return err
+		}
+	}
+
+	// username flag, the password that might follow is never decoded
+	if flags&0x80 != 0 {
+		if packet.Username, err = d.readString(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *mqttDecoder) connAck(packet *MQTTPacket) error {
+	flags, err := d.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	packet.SessionPresent = flags&0x01 != 0
+
+	code, err := d.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	packet.ReasonCodes = []byte{code}
+
+	// only mqtt 5.0 has properties after the return code
+	if len(d.buf) > 0 {
+		packet.ProtocolVersion = MQTTVersion5
+	}
+
+	return nil
+}
+
+func (d *mqttDecoder) publish(packet *MQTTPacket, flags byte) error {
+	packet.Retain = flags&0x01 != 0
+	packet.QoS = (flags >> 1) & 0x03
+	packet.Dup = flags&0x08 != 0
+
+	var err error
+	if packet.Topic, err = d.readString(); err != nil {
+		return err
+	}
+
+	if d.strict && (packet.QoS == 3 || !d.validTopic(packet, packet.Topic)) {
+		return errMQTTInvalidField
+	}
+
+	if packet.QoS > 0 {
+		if packet.PacketID, err = d.readUint16(); err != nil {
+			return err
+		}
+	}
+
+	if packet.ProtocolVersion == MQTTVersion5 {
+		if err := d.skipProperties(MQTTPublish); err != nil {
+			return err
+		}
+	} else if d.strict {
+		// a payload that starts with a non empty property list is more likely an mqtt 5.0 packet
+		probe := &mqttDecoder{buf: d.buf, strict: true}
+		if probe.skipProperties(MQTTPublish) == nil && len(probe.buf) < len(d.buf)-1 {
+			return errMQTTInvalidField
+		}
+	}
+
+	packet.Payload = d.buf
+
+	return nil
+}
+
+// ack decodes puback, pubrec, pubrel, pubcomp and unsuback packets.
+func (d *mqttDecoder) ack(packet *MQTTPacket) error {
+	var err error
+	if packet.PacketID, err = d.readUint16(); err != nil {
+		return err
+	}
+
+	// mqtt 3.1.1 acknowledgements end with the packet identifier
+	if len(d.buf) == 0 {
+		return nil
+	}
+
+	packet.ProtocolVersion = MQTTVersion5
+
+	if packet.Type == MQTTUnsubAck {
+		if err := d.skipProperties(MQTTUnsubAck); err != nil {
+			return err
+		}
+
+		packet.ReasonCodes = d.buf
+
+		return nil
+	}
+
+	code, err := d.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	packet.ReasonCodes = []byte{code}
+
+	return nil
+}
+
+// subscribe decodes subscribe and unsubscribe packets.
+func (d *mqttDecoder) subscribe(packet *MQTTPacket) error {
+	var err error
+	if packet.PacketID, err = d.readUint16(); err != nil {
+		return err
+	}
+
+	if packet.ProtocolVersion == MQTTVersion5 {
+		if err := d.skipProperties(packet.Type); err != nil {
+			return err
+		}
+	}
+
+	for len(d.buf) > 0 {
+		var subscription MQTTSubscription
+		if subscription.Topic, err = d.readString(); err != nil {
+			return err
+		}
+
+		if !d.validTopic(packet, subscription.Topic) {
+			return errMQTTInvalidField
+		}
+
+		if packet.Type == MQTTSubscribe {
+			options, err := d.ReadByte()
+			if err != nil {
+				return err
+			}
+
+			if d.strict && !validMQTTSubscriptionOptions(packet.ProtocolVersion, options) {
+				return errMQTTInvalidField
+			}
+
+			subscription.QoS = options & 0x03
+		}
+
+		packet.Subscriptions = append(packet.Subscriptions, subscription)
+	}
+
+	if d.strict && len(packet.Subscriptions) == 0 {
+		return errMQTTInvalidField
+	}
+
+	return nil
+}
+
+// validMQTTSubscriptionOptions reports whether the options byte of a subscription has a valid qos and
+// no reserved bits set. mqtt 3.1.1 has a qos only, mqtt 5.0 adds the no local, retain as published and
+// retain handling options.
+func validMQTTSubscriptionOptions(version byte, options byte) bool {
+	if options&0x03 == 3 {
+		return false
+	}
+
+	if version == MQTTVersion5 {
+		return options&0xc0 == 0 && (options>>4)&0x03 != 3
+	}
+
+	return options&0xfc == 0
+}
+
+func (d *mqttDecoder) subAck(packet *MQTTPacket) error {
+	var err error
+	if packet.PacketID, err = d.readUint16(); err != nil {
+		return err
+	}
+
+	if packet.ProtocolVersion == MQTTVersion5 {
+		if err := d.skipProperties(MQTTSubAck); err != nil {
+			return err
+		}
+	}
+
+	packet.ReasonCodes = d.buf
+
+	if d.strict {
+		codes := mqtt311SubAckCodes
+		if packet.ProtocolVersion == MQTTVersion5 {
+			codes = mqtt5SubAckCodes
+		}
+
+		if len(packet.ReasonCodes) == 0 {
+			return errMQTTInvalidField
+		}
+
+		for _, code := range packet.ReasonCodes {
+			if !codes[code] {
+				return errMQTTInvalidField
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package sniff
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly/tcpreader"
+	"github.com/pkg/errors"
+)
+
+// mqttConn is shared by both directions of an mqtt connection, so that the broker side can decode
+// packets with the protocol version the client asked for in its connect packet.
+type mqttConn struct {
+	version uint32
+}
+
+// mqttStream will handle the actual decoding of mqtt control packets.
+type mqttStream struct {
+	net, transport gopacket.Flow
+	r              tcpreader.ReaderStream
+	conn           *mqttConn
+	eventChan      chan Event
+	stats          *pipelineStats
+	report         func(event *ErrorEvent)
+	done           func()
+}
+
+func (m *mqttStream) run() {
+	defer m.done()
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			flow := Flow{Net: m.net, Transport: m.transport}
+			m.report(newErrorEvent("mqtt stream", flow, panicError(recovered), true))
+			// the rest of the stream is lost, but it must still be read until EOF.
+			_, _ = io.Copy(ioutil.Discard, &m.r)
+		}
+	}()
+
+	buf := bufio.NewReader(&m.r)
+
+	for {
+		packet, err := readMQTTPacket(buf, byte(atomic.LoadUint32(&m.conn.version)))
+		if err == io.EOF {
+			return
+		} else if errors.Cause(err) == errMQTTUnknownVersion {
+			// the packet is read completely, so the packets after it can still be decoded
+			atomic.AddUint64(&m.stats.mqttParseErrors, 1)
+
+			continue
+		} else if err != nil {
+			atomic.AddUint64(&m.stats.mqttParseErrors, 1)
+			// there is no way to find the next packet boundary in a broken stream, but we must still read
+			// until we see an EOF.
+			_, _ = io.Copy(ioutil.Discard, buf)
+
+			return
+		}
+
+		if packet.Type == MQTTConnect {
+			atomic.StoreUint32(&m.conn.version, uint32(packet.ProtocolVersion))
+		} else if packet.ProtocolVersion != 0 {
+			// connect packet is not captured, remember the version guessed from the packet layout
+			atomic.CompareAndSwapUint32(&m.conn.version, 0, uint32(packet.ProtocolVersion))
+		}
+
+		m.eventChan <- &MQTTEvent{
+			Flow:   Flow{Net: m.net, Transport: m.transport},
+			Packet: packet,
+		}
+	}
+}
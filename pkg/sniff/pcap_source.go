@@ -0,0 +1,93 @@
+//go:build cgo
+// +build cgo
+
+package sniff
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/pkg/errors"
+)
+
+/*
+	contains the libpcap backed packet sources, which need cgo
+*/
+
+const maxSnapLen = 65536
+
+const timeoutDuration = time.Second * 3
+
+// openPcap opens the live interface or the pcap file in cfg, with the bpf filter of cfg applied.
+func openPcap(cfg Cfg) (PacketSource, func(), error) {
+	var (
+		handle *pcap.Handle
+		err    error
+	)
+
+	switch cfg.IsLive {
+	case true:
+		handle, err = pcap.OpenLive(
+			cfg.InterfaceName, maxSnapLen, false, timeoutDuration,
+		)
+	case false:
+		handle, err = pcap.OpenOffline(cfg.PcapPath)
+	}
+
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to open packet capture")
+	}
+
+	if err := handle.SetBPFFilter(cfg.Filter); err != nil {
+		handle.Close()
+
+		return nil, nil, errors.WithMessagef(err, "failed to set bpf filter \"%s\"", cfg.Filter)
+	}
+
+	return &pcapSource{Handle: handle}, handle.Close, nil
+}
+
+// pcapSource is a libpcap handle, which reports the capture counters of libpcap.
+type pcapSource struct {
+	*pcap.Handle
+}
+
+func (s *pcapSource) CaptureStats() (CaptureStats, error) {
+	stats, err := s.Handle.Stats()
+	if err != nil {
+		return CaptureStats{}, errors.Wrap(err, "failed to get capture stats")
+	}
+
+	return CaptureStats{
+		Received:         uint64(stats.PacketsReceived),
+		Dropped:          uint64(stats.PacketsDropped),
+		InterfaceDropped: uint64(stats.PacketsIfDropped),
+	}, nil
+}
+
+// bpfSource skips the packets of a source that do not match a bpf filter, for sources that are not
+// opened by libpcap.
+type bpfSource struct {
+	PacketSource
+	bpf *pcap.BPF
+}
+
+func (s *bpfSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := s.PacketSource.ReadPacketData()
+		if err != nil || s.bpf.Matches(ci, data) {
+			return data, ci, err
+		}
+	}
+}
+
+// filterSource applies the bpf filter expression to the packets of source.
+func filterSource(source PacketSource, filter string) (PacketSource, error) {
+	bpf, err := pcap.NewBPF(source.LinkType(), maxSnapLen, filter)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to compile bpf filter \"%s\"", filter)
+	}
+
+	return &bpfSource{PacketSource: source, bpf: bpf}, nil
+}
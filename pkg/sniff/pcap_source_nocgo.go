@@ -0,0 +1,22 @@
+//go:build !cgo
+// +build !cgo
+
+package sniff
+
+import (
+	"github.com/pkg/errors"
+)
+
+/*
+	stands in for the libpcap backed packet sources when gniffer is built without cgo
+*/
+
+var errNoPcap = errors.New("gniffer is built without libpcap support, use a packet source instead")
+
+func openPcap(cfg Cfg) (PacketSource, func(), error) {
+	return nil, nil, errNoPcap
+}
+
+func filterSource(source PacketSource, filter string) (PacketSource, error) {
+	return nil, errNoPcap
+}
@@ -0,0 +1,133 @@
+package sniff
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	contains the pacing of captures replayed from files, which follows the timestamps of the packets or a
+	fixed rate of requests
+*/
+
+// ReplayCfg configures how fast packets are read from sources that are not live, such as pcap files.
+// Without pacing, they are read as fast as possible.
+type ReplayCfg struct {
+	// Speed replays the packets at their capture timing multiplied by speed, e.g. 0.5 is half as fast and
+	// 10 is ten times as fast as captured. 0 disables it.
+	Speed float64 `json:"speed" mapstructure:"SPEED"`
+	// RequestsPerSecond replays the requests at a fixed rate instead of their capture timing, 0 disables
+	// it. It can not be used with Speed.
+	RequestsPerSecond float64 `json:"requests_per_second" mapstructure:"REQUESTS_PER_SECOND"`
+	// MaxConcurrency is the number of requests the proxy sends at the same time across its targets, 0 does
+	// not limit them. Requests wait for a free slot, so the replay falls behind its pace while the limit is
+	// reached.
+	MaxConcurrency int `json:"max_concurrency" mapstructure:"MAX_CONCURRENCY"`
+}
+
+func (c ReplayCfg) validate() error {
+	if c.Speed < 0 || c.RequestsPerSecond < 0 || c.MaxConcurrency < 0 {
+		return errors.New("replay can not have a negative speed, rate or concurrency")
+	}
+
+	if c.Speed > 0 && c.RequestsPerSecond > 0 {
+		return errors.New("replay can follow the capture timing or a fixed rate of requests, not both")
+	}
+
+	return nil
+}
+
+// replayClock maps the capture times of packets to the times they are replayed at.
+type replayClock struct {
+	speed float64
+	// start is when the first packet is replayed, and first is when it is captured.
+	start time.Time
+	first time.Time
+}
+
+// wait waits until the packet captured at ts is due. It reports false if ctx is done or stop is closed in
+// the meantime.
+func (c *replayClock) wait(ctx context.Context, stop <-chan struct{}, ts time.Time) bool {
+	if c.start.IsZero() {
+		c.start, c.first = time.Now(), ts
+
+		return true
+	}
+
+	due := c.start.Add(time.Duration(float64(ts.Sub(c.first)) / c.speed))
+
+	delay := time.Until(due)
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// now returns the capture time that is being replayed now. It is the current time before the first
+// packet.
+func (c *replayClock) now() time.Time {
+	if c.start.IsZero() {
+		return time.Now()
+	}
+
+	return c.first.Add(time.Duration(float64(time.Since(c.start)) * c.speed))
+}
+
+// rateLimiter spaces events out at a fixed rate.
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait waits for the next slot of the rate. It reports false if ctx is done in the meantime. Once stop is
+// closed it does not wait anymore, so that the events left are handled before the drain runs out of time. A
+// limiter that is not used for a while does not make up for it with a burst.
+func (l *rateLimiter) wait(ctx context.Context, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+	}
+
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+
+	due := l.next
+	l.next = l.next.Add(l.interval)
+
+	delay := time.Until(due)
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-stop:
+		return true
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,191 @@
+package sniff
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/strixeyecom/gniffer/pkg/diskqueue"
+)
+
+/*
+	contains the durable queue of requests mirrored to a target, which keeps them on disk while the target
+	is down or slow and across restarts
+*/
+
+const (
+	// defaultRequestQueueMaxSize is the default limit of the disk space a request queue uses.
+	defaultRequestQueueMaxSize = 1 << 30
+	// minRequestQueueSegmentSize is the smallest segment of a request queue. Segments are a fraction of the
+	// size limit, so that trimming the queue drops a small share of it at a time.
+	minRequestQueueSegmentSize = 1 << 20
+	requestQueueSegments       = 16
+)
+
+// DiskQueueCfg configures the durable queue of the requests of a target.
+type DiskQueueCfg struct {
+	// Dir is the directory the queues are kept in, every target has its own directory in it. The queues
+	// are disabled when it is empty.
+	Dir string `json:"dir" mapstructure:"DIR"`
+	// MaxSize is the disk space a queue may use in bytes. The oldest requests are dropped once it is
+	// reached. (default: 1GB)
+	MaxSize int64 `json:"max_size" mapstructure:"MAX_SIZE"`
+	// MaxAge drops the requests that have been queued for longer, 0 keeps them until they are sent.
+	MaxAge time.Duration `json:"max_age" mapstructure:"MAX_AGE"`
+	// DrainRate is the number of requests per second taken from the queue, 0 takes them as fast as the
+	// target handles them.
+	DrainRate float64 `json:"drain_rate" mapstructure:"DRAIN_RATE"`
+}
+
+// RequestQueueStats are the counters of a request queue.
+type RequestQueueStats struct {
+	Name string
+	// Queued is the number of requests in the queue, and Size is the disk space it uses in bytes.
+	Queued int
+	Size   int64
+	// Expired is the number of requests dropped by the age limit, and Trimmed is the number of requests
+	// dropped by the size limit.
+	Expired uint64
+	Trimmed uint64
+}
+
+// RequestQueue is a durable fifo queue of requests, kept in a diskqueue.Queue. Requests are stored in
+// wire format, so only their method, url, headers and body are kept. It is safe for concurrent use.
+type RequestQueue struct {
+	name  string
+	cfg   DiskQueueCfg
+	queue *diskqueue.Queue
+
+	expired uint64
+	trimmed uint64
+}
+
+// queuedRequest is the gob encoded form of a queued request.
+type queuedRequest struct {
+	Time time.Time
+	// Request is the request in wire format.
+	Request    []byte
+	RemoteAddr string
+}
+
+// OpenRequestQueue opens the queue in dir, continuing with the requests a previous queue left in it. Its
+// counters are reported with name.
+func OpenRequestQueue(name, dir string, cfg DiskQueueCfg) (*RequestQueue, error) {
+	if cfg.MaxSize < 0 || cfg.MaxAge < 0 || cfg.DrainRate < 0 {
+		return nil, errors.Errorf("disk queue of %s can not have a negative limit or rate", name)
+	}
+
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = defaultRequestQueueMaxSize
+	}
+
+	segmentSize := cfg.MaxSize / requestQueueSegments
+	if segmentSize < minRequestQueueSegmentSize {
+		segmentSize = minRequestQueueSegmentSize
+	}
+
+	queue, err := diskqueue.Open(dir, segmentSize)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to open disk queue of %s", name)
+	}
+
+	return &RequestQueue{name: name, cfg: cfg, queue: queue}, nil
+}
+
+// Push appends req to the queue without consuming its body, and drops the oldest requests if the queue
+// is over its size limit.
+func (q *RequestQueue) Push(req *http.Request) error {
+	raw, err := dumpRequest(req)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+
+	err = gob.NewEncoder(&buf).Encode(&queuedRequest{Time: time.Now(), Request: raw, RemoteAddr: req.RemoteAddr})
+	if err != nil {
+		return errors.Wrap(err, "failed to encode request")
+	}
+
+	if err := q.queue.Push(buf.Bytes()); err != nil {
+		return err
+	}
+
+	trimmed, err := q.queue.Trim(q.cfg.MaxSize)
+	atomic.AddUint64(&q.trimmed, uint64(trimmed))
+
+	return err
+}
+
+// Pop removes and returns the oldest request that is not over the age limit, dropping the ones that are.
+// ok is false if the queue is empty. The url of the request only has its path and query.
+func (q *RequestQueue) Pop() (req *http.Request, ok bool, err error) {
+	for {
+		raw, ok, err := q.queue.Pop()
+		if err != nil || !ok {
+			return nil, false, err
+		}
+
+		var queued queuedRequest
+		if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&queued); err != nil {
+			return nil, false, errors.Wrap(err, "failed to decode queued request")
+		}
+
+		if q.cfg.MaxAge > 0 && time.Since(queued.Time) > q.cfg.MaxAge {
+			atomic.AddUint64(&q.expired, 1)
+
+			continue
+		}
+
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(queued.Request)))
+		if err != nil {
+			return nil, false, errors.Wrap(err, "failed to decode queued request")
+		}
+
+		req.RemoteAddr = queued.RemoteAddr
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, false, errors.Wrap(err, "failed to decode queued request")
+		}
+
+		setBody(req, body)
+
+		return req, true, nil
+	}
+}
+
+// Pushed returns a channel that receives a value after requests are pushed.
+func (q *RequestQueue) Pushed() <-chan struct{} {
+	return q.queue.Pushed()
+}
+
+// DrainInterval returns the wait between two requests taken from the queue, 0 if they are not paced.
+func (q *RequestQueue) DrainInterval() time.Duration {
+	if q.cfg.DrainRate == 0 {
+		return 0
+	}
+
+	return time.Duration(float64(time.Second) / q.cfg.DrainRate)
+}
+
+// Close closes the queue, the requests in it are kept for the next time it is opened.
+func (q *RequestQueue) Close() error {
+	return q.queue.Close()
+}
+
+// Stats returns the counters of the queue.
+func (q *RequestQueue) Stats() RequestQueueStats {
+	return RequestQueueStats{
+		Name:    q.name,
+		Queued:  q.queue.Len(),
+		Size:    q.queue.Size(),
+		Expired: atomic.LoadUint64(&q.expired),
+		Trimmed: atomic.LoadUint64(&q.trimmed),
+	}
+}
@@ -0,0 +1,689 @@
+package sniff
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	contains the rewrite rules that change mirrored requests before they are sent to a target
+*/
+
+// RewriteRule changes a part of a request. A rule selects a single part with one of Header, Cookie, Query,
+// Body, Path, Host or Method, and changes it with one of Set, Add, Remove, Rename or Replace:
+//
+//	header, cookie, query: set, add (header and query only), remove, rename, replace
+//	body:                  set, remove, replace
+//	path, host:            set, replace
+//	method:                set
+//
+// Header, Cookie and Query are names, Body is the dot separated path of a field of a json body, such as
+// user.emails.0. Path and Host are regular expressions the path or the host has to match for the rule to
+// apply, and Method is the method the request has to have, or * for any.
+//
+// Replace replaces the matches of Match in the values of the header, cookie, query parameter or string
+// body field, or the matches of Path or Host in the path or the host. It can refer to the groups of the
+// expression, e.g. $1.
+type RewriteRule struct {
+	Header string `json:"header" mapstructure:"HEADER"`
+	Cookie string `json:"cookie" mapstructure:"COOKIE"`
+	Query  string `json:"query" mapstructure:"QUERY"`
+	Body   string `json:"body" mapstructure:"BODY"`
+	Path   string `json:"path" mapstructure:"PATH"`
+	Host   string `json:"host" mapstructure:"HOST"`
+	Method string `json:"method" mapstructure:"METHOD"`
+
+	// Set is any json value for body fields, and a string for the other parts.
+	Set     interface{} `json:"set" mapstructure:"SET"`
+	Add     string      `json:"add" mapstructure:"ADD"`
+	Remove  bool        `json:"remove" mapstructure:"REMOVE"`
+	Rename  string      `json:"rename" mapstructure:"RENAME"`
+	Match   string      `json:"match" mapstructure:"MATCH"`
+	Replace *string     `json:"replace" mapstructure:"REPLACE"`
+}
+
+// Rewriter applies rewrite rules to requests, in the order of the rules. It is safe for concurrent use.
+type Rewriter struct {
+	rules []rewriteFunc
+}
+
+type rewriteFunc func(r *rewrite)
+
+// rewrite is a request being rewritten. Its json body is decoded by the first body rule, and encoded
+// again after the last rule.
+type rewrite struct {
+	req *http.Request
+
+	body    interface{}
+	decoded bool
+	isJSON  bool
+	changed bool
+}
+
+// NewRewriter compiles the rules.
+func NewRewriter(rules []RewriteRule) (*Rewriter, error) {
+	r := &Rewriter{rules: make([]rewriteFunc, 0, len(rules))}
+
+	for i, rule := range rules {
+		fn, err := compileRewrite(rule)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "invalid rewrite rule %d", i)
+		}
+
+		r.rules = append(r.rules, fn)
+	}
+
+	return r, nil
+}
+
+// Rewrite applies the rules to req. The body of req is replaced if a rule changes it, and json bodies that
+// can not be decoded are left as they are.
+func (r *Rewriter) Rewrite(req *http.Request) error {
+	if len(r.rules) == 0 {
+		return nil
+	}
+
+	state := &rewrite{req: req}
+
+	for _, rule := range r.rules {
+		rule(state)
+	}
+
+	if !state.changed {
+		return nil
+	}
+
+	body, err := json.Marshal(state.body)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode rewritten body")
+	}
+
+	setBody(req, body)
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+
+	return nil
+}
+
+// jsonBody returns the decoded json body of the request, and whether it is json.
+func (r *rewrite) jsonBody() (interface{}, bool) {
+	if r.decoded {
+		return r.body, r.isJSON
+	}
+
+	r.decoded = true
+
+	raw, err := requestBody(r.req)
+	if err != nil || len(bytes.TrimSpace(raw)) == 0 {
+		return nil, false
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&r.body); err != nil || decoder.More() {
+		return nil, false
+	}
+
+	r.isJSON = true
+
+	return r.body, true
+}
+
+// requestBody reads the body of req and puts it back, so that it can be sent.
+func requestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+
+		defer body.Close()
+
+		return ioutil.ReadAll(body)
+	}
+
+	raw, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	setBody(req, raw)
+
+	return raw, nil
+}
+
+func compileRewrite(rule RewriteRule) (rewriteFunc, error) {
+	parts := map[string]string{
+		"header": rule.Header, "cookie": rule.Cookie, "query": rule.Query, "body": rule.Body, "path": rule.Path,
+		"host": rule.Host, "method": rule.Method,
+	}
+
+	part, name, err := only(parts, "a header, cookie, query, body, path, host or method")
+	if err != nil {
+		return nil, err
+	}
+
+	actions := map[string]bool{
+		"set": rule.Set != nil, "add": rule.Add != "", "remove": rule.Remove, "rename": rule.Rename != "",
+		"replace": rule.Replace != nil,
+	}
+
+	selected := make(map[string]string, len(actions))
+
+	for action, ok := range actions {
+		if ok {
+			selected[action] = action
+		}
+	}
+
+	action, _, err := only(selected, "set, add, remove, rename or replace")
+	if err != nil {
+		return nil, err
+	}
+
+	if rule.Match != "" && (action != "replace" || part == "path" || part == "host") {
+		return nil, errors.New("match is only used to replace header, cookie, query and body values")
+	}
+
+	switch part {
+	case "header":
+		return headerRewrite(name, action, rule)
+	case "cookie":
+		return cookieRewrite(name, action, rule)
+	case "query":
+		return queryRewrite(name, action, rule)
+	case "body":
+		return bodyRewrite(name, action, rule)
+	case "path", "host":
+		return urlRewrite(part, name, action, rule)
+	default:
+		return methodRewrite(name, action, rule)
+	}
+}
+
+// only returns the single set value of values, and fails if none or more than one of them is set.
+func only(values map[string]string, expected string) (key, value string, err error) {
+	for k, v := range values {
+		if v == "" {
+			continue
+		}
+
+		if key != "" {
+			keys := []string{key, k}
+			if keys[0] > keys[1] {
+				keys[0], keys[1] = keys[1], keys[0]
+			}
+
+			return "", "", errors.Errorf(
+				"rule has both %s and %s, expected one of %s", keys[0], keys[1], expected,
+			)
+		}
+
+		key, value = k, v
+	}
+
+	if key == "" {
+		return "", "", errors.Errorf("rule has none of %s", expected)
+	}
+
+	return key, value, nil
+}
+
+func unsupported(part, action string) error {
+	return errors.Errorf("%s rules can not %s", part, action)
+}
+
+// setValue returns the value of a set action of a header, cookie, query, path, host or method rule.
+func setValue(rule RewriteRule) (string, error) {
+	switch value := rule.Set.(type) {
+	case string:
+		return value, nil
+	case bool, int, int64, float64:
+		return fmt.Sprint(value), nil
+	}
+
+	return "", errors.Errorf("set value %v is not a string", rule.Set)
+}
+
+// replacer returns the function that replaces the matches of match with the replacement of the rule.
+func replacer(match string, rule RewriteRule) (func(value string) string, error) {
+	if match == "" {
+		return nil, errors.New("replace needs a match expression")
+	}
+
+	re, err := regexp.Compile(match)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid expression %q", match)
+	}
+
+	replacement := *rule.Replace
+
+	return func(value string) string {
+		return re.ReplaceAllString(value, replacement)
+	}, nil
+}
+
+func headerRewrite(name, action string, rule RewriteRule) (rewriteFunc, error) {
+	switch action {
+	case "set":
+		value, err := setValue(rule)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(r *rewrite) { r.req.Header.Set(name, value) }, nil
+	case "add":
+		return func(r *rewrite) { r.req.Header.Add(name, rule.Add) }, nil
+	case "remove":
+		return func(r *rewrite) { r.req.Header.Del(name) }, nil
+	case "rename":
+		return func(r *rewrite) {
+			values := r.req.Header.Values(name)
+			if len(values) == 0 {
+				return
+			}
+
+			r.req.Header.Del(name)
+
+			for _, value := range values {
+				r.req.Header.Add(rule.Rename, value)
+			}
+		}, nil
+	default:
+		replace, err := replacer(rule.Match, rule)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(r *rewrite) {
+			key := http.CanonicalHeaderKey(name)
+			for i, value := range r.req.Header[key] {
+				r.req.Header[key][i] = replace(value)
+			}
+		}, nil
+	}
+}
+
+func cookieRewrite(name, action string, rule RewriteRule) (rewriteFunc, error) {
+	var change func(cookies []*http.Cookie) []*http.Cookie
+
+	switch action {
+	case "set":
+		value, err := setValue(rule)
+		if err != nil {
+			return nil, err
+		}
+
+		change = func(cookies []*http.Cookie) []*http.Cookie {
+			for _, cookie := range cookies {
+				if cookie.Name == name {
+					cookie.Value = value
+				}
+			}
+
+			return cookies
+		}
+	case "remove":
+		change = func(cookies []*http.Cookie) []*http.Cookie {
+			kept := cookies[:0]
+
+			for _, cookie := range cookies {
+				if cookie.Name != name {
+					kept = append(kept, cookie)
+				}
+			}
+
+			return kept
+		}
+	case "rename":
+		change = func(cookies []*http.Cookie) []*http.Cookie {
+			for _, cookie := range cookies {
+				if cookie.Name == name {
+					cookie.Name = rule.Rename
+				}
+			}
+
+			return cookies
+		}
+	case "replace":
+		replace, err := replacer(rule.Match, rule)
+		if err != nil {
+			return nil, err
+		}
+
+		change = func(cookies []*http.Cookie) []*http.Cookie {
+			for _, cookie := range cookies {
+				if cookie.Name == name {
+					cookie.Value = replace(cookie.Value)
+				}
+			}
+
+			return cookies
+		}
+	default:
+		return nil, unsupported("cookie", action)
+	}
+
+	return func(r *rewrite) {
+		cookies := r.req.Cookies()
+		if len(cookies) == 0 {
+			return
+		}
+
+		cookies = change(cookies)
+
+		r.req.Header.Del("Cookie")
+
+		for _, cookie := range cookies {
+			r.req.AddCookie(cookie)
+		}
+	}, nil
+}
+
+func queryRewrite(name, action string, rule RewriteRule) (rewriteFunc, error) {
+	var change func(query url.Values)
+
+	switch action {
+	case "set":
+		value, err := setValue(rule)
+		if err != nil {
+			return nil, err
+		}
+
+		change = func(query url.Values) { query[name] = []string{value} }
+	case "add":
+		change = func(query url.Values) { query[name] = append(query[name], rule.Add) }
+	case "remove":
+		change = func(query url.Values) { delete(query, name) }
+	case "rename":
+		change = func(query url.Values) {
+			if values, ok := query[name]; ok {
+				delete(query, name)
+				query[rule.Rename] = append(query[rule.Rename], values...)
+			}
+		}
+	default:
+		replace, err := replacer(rule.Match, rule)
+		if err != nil {
+			return nil, err
+		}
+
+		change = func(query url.Values) {
+			for i, value := range query[name] {
+				query[name][i] = replace(value)
+			}
+		}
+	}
+
+	return func(r *rewrite) {
+		query := r.req.URL.Query()
+		change(query)
+		r.req.URL.RawQuery = query.Encode()
+	}, nil
+}
+
+func urlRewrite(part, expr, action string, rule RewriteRule) (rewriteFunc, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s expression %q", part, expr)
+	}
+
+	var change func(value string) string
+
+	switch action {
+	case "set":
+		value, err := setValue(rule)
+		if err != nil {
+			return nil, err
+		}
+
+		change = func(string) string { return value }
+	case "replace":
+		replacement := *rule.Replace
+		change = func(value string) string { return re.ReplaceAllString(value, replacement) }
+	default:
+		return nil, unsupported(part, action)
+	}
+
+	if part == "host" {
+		return func(r *rewrite) {
+			if re.MatchString(r.req.Host) {
+				r.req.Host = change(r.req.Host)
+			}
+		}, nil
+	}
+
+	return func(r *rewrite) {
+		if re.MatchString(r.req.URL.Path) {
+			r.req.URL.Path = change(r.req.URL.Path)
+			r.req.URL.RawPath = ""
+		}
+	}, nil
+}
+
+func methodRewrite(method, action string, rule RewriteRule) (rewriteFunc, error) {
+	if action != "set" {
+		return nil, unsupported("method", action)
+	}
+
+	value, err := setValue(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	value = strings.ToUpper(value)
+
+	return func(r *rewrite) {
+		if method == "*" || strings.EqualFold(r.req.Method, method) {
+			r.req.Method = value
+		}
+	}, nil
+}
+
+func bodyRewrite(field, action string, rule RewriteRule) (rewriteFunc, error) {
+	path := strings.Split(field, ".")
+
+	var change func(parent interface{}, key string) bool
+
+	switch action {
+	case "set":
+		value, err := jsonValue(rule.Set)
+		if err != nil {
+			return nil, err
+		}
+
+		change = func(parent interface{}, key string) bool {
+			// every request gets a copy, later rules may change the objects of the value in its body
+			return setField(parent, key, copyJSON(value))
+		}
+	case "remove":
+		change = func(parent interface{}, key string) bool {
+			object, ok := parent.(map[string]interface{})
+			if !ok {
+				return false
+			}
+
+			if _, ok := object[key]; !ok {
+				return false
+			}
+
+			delete(object, key)
+
+			return true
+		}
+	case "replace":
+		replace, err := replacer(rule.Match, rule)
+		if err != nil {
+			return nil, err
+		}
+
+		change = func(parent interface{}, key string) bool {
+			value, ok := getField(parent, key).(string)
+			if !ok {
+				return false
+			}
+
+			return setField(parent, key, replace(value))
+		}
+	default:
+		return nil, unsupported("body", action)
+	}
+
+	return func(r *rewrite) {
+		body, ok := r.jsonBody()
+		if !ok {
+			return
+		}
+
+		parent := body
+
+		for _, key := range path[:len(path)-1] {
+			child := getField(parent, key)
+			if child == nil && action == "set" {
+				// set creates the objects on the way to the field
+				if object, ok := parent.(map[string]interface{}); ok {
+					child = make(map[string]interface{})
+					object[key] = child
+				}
+			}
+
+			if child == nil {
+				return
+			}
+
+			parent = child
+		}
+
+		if change(parent, path[len(path)-1]) {
+			r.changed = true
+		}
+	}, nil
+}
+
+// getField returns the field key of an object, or the element at index key of an array. It returns nil
+// if there is no such field.
+func getField(parent interface{}, key string) interface{} {
+	switch parent := parent.(type) {
+	case map[string]interface{}:
+		return parent[key]
+	case []interface{}:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(parent) {
+			return nil
+		}
+
+		return parent[i]
+	}
+
+	return nil
+}
+
+// setField sets the field key of an object, or the existing element at index key of an array.
+func setField(parent interface{}, key string, value interface{}) bool {
+	switch parent := parent.(type) {
+	case map[string]interface{}:
+		parent[key] = value
+
+		return true
+	case []interface{}:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(parent) {
+			return false
+		}
+
+		parent[i] = value
+
+		return true
+	}
+
+	return false
+}
+
+// copyJSON returns a deep copy of a value decoded from json or converted by jsonValue. Only objects and
+// arrays are copied, the other values can not be changed.
+func copyJSON(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(value))
+		for key, v := range value {
+			object[key] = copyJSON(v)
+		}
+
+		return object
+	case []interface{}:
+		array := make([]interface{}, len(value))
+		for i, v := range value {
+			array[i] = copyJSON(v)
+		}
+
+		return array
+	}
+
+	return value
+}
+
+// jsonValue converts a value decoded from the config into a value json can encode. yaml decodes objects
+// into maps with interface keys, which json can not encode.
+func jsonValue(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(value))
+
+		for key, v := range value {
+			converted, err := jsonValue(v)
+			if err != nil {
+				return nil, err
+			}
+
+			object[fmt.Sprint(key)] = converted
+		}
+
+		return object, nil
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(value))
+
+		for key, v := range value {
+			converted, err := jsonValue(v)
+			if err != nil {
+				return nil, err
+			}
+
+			object[key] = converted
+		}
+
+		return object, nil
+	case []interface{}:
+		array := make([]interface{}, len(value))
+
+		for i, v := range value {
+			converted, err := jsonValue(v)
+			if err != nil {
+				return nil, err
+			}
+
+			array[i] = converted
+		}
+
+		return array, nil
+	}
+
+	if _, err := json.Marshal(value); err != nil {
+		return nil, errors.Wrapf(err, "set value %v can not be encoded as json", value)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,51 @@
+package sniff
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+	contains the normalization of request paths into routes, which group the requests to the same endpoint
+*/
+
+var (
+	uuidSegment  = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegment   = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	tokenSegment = regexp.MustCompile(`^[0-9A-Za-z_\-=.]{24,}$`)
+)
+
+// NormalizeRoute replaces the path segments that look like identifiers with ":id", so that requests to
+// the same endpoint share a route. Numbers, uuids, long hex strings and long tokens with digits are
+// identifiers.
+func NormalizeRoute(path string) string {
+	if path == "" || path == "/" {
+		return "/"
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if isIdentifier(segment) {
+			segments[i] = ":id"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func isIdentifier(segment string) bool {
+	if segment == "" {
+		return false
+	}
+
+	if _, err := strconv.ParseUint(segment, 10, 64); err == nil {
+		return true
+	}
+
+	if uuidSegment.MatchString(segment) || hexSegment.MatchString(segment) {
+		return true
+	}
+
+	return tokenSegment.MatchString(segment) && strings.ContainsAny(segment, "0123456789")
+}
@@ -0,0 +1,271 @@
+package sniff
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	contains the sampling stages that keep a share of the requests, so that targets get a fraction of the
+	traffic instead of all of it
+*/
+
+// maxRateLimitedRoutes is the number of host and route pairs that get their own rate limit. Requests to
+// the pairs seen after it share a single limit, so that unexpected paths can not grow the limits without
+// bounds.
+const maxRateLimitedRoutes = 10000
+
+// SamplingCfg configures which share of the requests a handler gets.
+type SamplingCfg struct {
+	// Percent is the percentage of requests kept, between 0 and 100. (default: 100)
+	Percent *float64 `json:"percent" mapstructure:"PERCENT"`
+	// Key makes the percentage consistent: requests with the same key are all kept or all dropped, so
+	// that whole user sessions are mirrored. It is client_ip, header:<name>, cookie:<name> or claim:<name>
+	// for a claim of the bearer token. Requests without the key are sampled randomly. (default: every
+	// request is sampled randomly)
+	Key string `json:"key" mapstructure:"KEY"`
+	// MaxPerSecond caps the kept requests per second of every host and route, 0 disables the cap.
+	MaxPerSecond float64 `json:"max_per_second" mapstructure:"MAX_PER_SECOND"`
+}
+
+// SamplingStats are the counters of a sampler.
+type SamplingStats struct {
+	Name string
+	// Sampled is the number of requests kept. Unsampled is the number of requests dropped by the
+	// percentage, and RateLimited is the number of requests dropped by the per route cap.
+	Sampled     uint64
+	Unsampled   uint64
+	RateLimited uint64
+}
+
+// Sampler keeps a share of the requests, first by the percentage and then by the per route cap of its
+// configuration. It is safe for concurrent use.
+type Sampler struct {
+	name      string
+	threshold uint64
+	key       func(req *http.Request) (string, bool)
+	limits    *routeLimits
+
+	sampled     uint64
+	unsampled   uint64
+	rateLimited uint64
+}
+
+// NewSampler creates a sampler, whose counters are reported with name.
+func NewSampler(name string, cfg SamplingCfg) (*Sampler, error) {
+	percent := 100.0
+	if cfg.Percent != nil {
+		percent = *cfg.Percent
+	}
+
+	if percent < 0 || percent > 100 {
+		return nil, errors.Errorf("sampling percent %g is not between 0 and 100", percent)
+	}
+
+	if cfg.MaxPerSecond < 0 {
+		return nil, errors.Errorf("sampling max per second %g is negative", cfg.MaxPerSecond)
+	}
+
+	key, err := requestKey(cfg.Key)
+	if err != nil {
+		return nil, errors.WithMessage(err, "sampling")
+	}
+
+	s := &Sampler{
+		name:      name,
+		threshold: uint64(math.Round(percent / 100 * math.MaxUint32)),
+		key:       key,
+	}
+
+	if cfg.MaxPerSecond > 0 {
+		s.limits = newRouteLimits(cfg.MaxPerSecond)
+	}
+
+	return s, nil
+}
+
+// requestKey returns the function that reads a key from requests, such as the key of consistent sampling.
+// The key is client_ip, header:<name>, cookie:<name>, or claim:<name> for a claim of the bearer token.
+func requestKey(key string) (func(req *http.Request) (string, bool), error) {
+	kind, name := key, ""
+	if i := strings.IndexByte(key, ':'); i >= 0 {
+		kind, name = key[:i], key[i+1:]
+	}
+
+	switch {
+	case key == "":
+		return nil, nil
+	case kind == "client_ip" && name == "":
+		return clientIP, nil
+	case kind == "header" && name != "":
+		return func(req *http.Request) (string, bool) {
+			value := req.Header.Get(name)
+
+			return value, value != ""
+		}, nil
+	case kind == "cookie" && name != "":
+		return func(req *http.Request) (string, bool) {
+			cookie, err := req.Cookie(name)
+			if err != nil || cookie.Value == "" {
+				return "", false
+			}
+
+			return cookie.Value, true
+		}, nil
+	case kind == "claim" && name != "":
+		return func(req *http.Request) (string, bool) {
+			return bearerClaim(req, name)
+		}, nil
+	}
+
+	return nil, errors.Errorf(
+		"invalid key %q, expected client_ip, header:<name>, cookie:<name> or claim:<name>", key,
+	)
+}
+
+// clientIP returns the ip of the client of the request, from its flow if it is handed to a handler by
+// the sniffer.
+func clientIP(req *http.Request) (string, bool) {
+	if flow, ok := RequestFlow(req); ok {
+		return flow.Net.Src().String(), true
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return "", false
+	}
+
+	return host, true
+}
+
+// Keep reports whether the request is sampled, and counts it.
+func (s *Sampler) Keep(req *http.Request) bool {
+	if !s.inPercent(req) {
+		atomic.AddUint64(&s.unsampled, 1)
+
+		return false
+	}
+
+	if s.limits != nil && !s.limits.allow(routeOf(req), time.Now()) {
+		atomic.AddUint64(&s.rateLimited, 1)
+
+		return false
+	}
+
+	atomic.AddUint64(&s.sampled, 1)
+
+	return true
+}
+
+// routeOf returns the host and the route of the request, which requests to the same endpoint share.
+func routeOf(req *http.Request) string {
+	return strings.ToLower(hostOf(req)) + " " + NormalizeRoute(req.URL.Path)
+}
+
+func (s *Sampler) inPercent(req *http.Request) bool {
+	if s.threshold >= math.MaxUint32 {
+		return true
+	}
+
+	if s.key != nil {
+		if key, ok := s.key(req); ok {
+			return keyHash(key) < s.threshold
+		}
+	}
+
+	return uint64(rand.Uint32()) < s.threshold // nolint:gosec // sampling does not need crypto rand
+}
+
+// keyHash hashes key into 32 bits. fnv alone spreads similar keys such as sequential ids unevenly, so its
+// result is mixed with the murmur3 finalizer.
+func keyHash(key string) uint64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(key))
+
+	h := hash.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return h >> 32
+}
+
+// Middleware passes only the sampled requests to the next handler.
+func (s *Sampler) Middleware() Middleware {
+	return Filter(s.Keep)
+}
+
+// Stats returns the counters of the sampler.
+func (s *Sampler) Stats() SamplingStats {
+	return SamplingStats{
+		Name:        s.name,
+		Sampled:     atomic.LoadUint64(&s.sampled),
+		Unsampled:   atomic.LoadUint64(&s.unsampled),
+		RateLimited: atomic.LoadUint64(&s.rateLimited),
+	}
+}
+
+// routeLimits are token buckets per host and route, which refill at rate tokens per second up to a burst
+// of one second.
+type routeLimits struct {
+	rate    float64
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// others is shared by the routes seen after maxRateLimitedRoutes.
+	others *tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRouteLimits(rate float64) *routeLimits {
+	return &routeLimits{
+		rate:    rate,
+		buckets: make(map[string]*tokenBucket),
+		others:  &tokenBucket{tokens: math.Max(rate, 1)},
+	}
+}
+
+func (l *routeLimits) allow(route string, now time.Time) bool {
+	burst := math.Max(l.rate, 1)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[route]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitedRoutes {
+			bucket = l.others
+		} else {
+			bucket = &tokenBucket{tokens: burst, last: now}
+			l.buckets[route] = bucket
+		}
+	}
+
+	if !bucket.last.IsZero() {
+		bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	}
+
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+
+	return true
+}
@@ -2,12 +2,14 @@ package sniff
 
 import (
 	"context"
-	"net/http"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/tcpassembly"
 	"github.com/pkg/errors"
 )
@@ -18,18 +20,44 @@ import (
 
 type sniffer struct {
 	assembler *tcpassembly.Assembler
-	factory   *httpStreamFactory
+	factory   *streamFactory
 	// config contains sniffing related configuration
 	config Cfg
-	// handler functions to process the http requests
-	handlers []Handler
+	// eventChan carries the events decoded by the streams to the handlers
+	eventChan chan Event
+	// handlers process the decoded events, each on its own workers
+	handlers []*handlerQueue
+	// subscriptions receive the decoded events on channels
+	subscriptions *subscriptions
+	// source is where packets are read from, if nil the interface or pcap file in config is opened
+	source PacketSource
+	// stats are the counters of the packet reading loop and the streams
+	stats *pipelineStats
+	// errorHandler receives the error events, which are logged if it is nil
+	errorHandler ErrorHandler
+	// captureSource is the opened source, before the bpf filter, whose capture counters are reported
+	captureSource   PacketSource
+	captureSourceMu sync.Mutex
+
+	// stopping is closed by Shutdown, to stop reading packets and drain the pipeline
+	stopping chan struct{}
+	stopOnce sync.Once
+	// cancelRun aborts a running Run, and runDone is closed when it returns
+	cancelRun func()
+	runDone   chan struct{}
+	runMu     sync.Mutex
 }
 
-func newSniffer(cfg Cfg) *sniffer {
+func newSniffer(cfg Cfg, source PacketSource) *sniffer {
 	s := &sniffer{
-		config:  cfg,
-		factory: &httpStreamFactory{requestChan: make(chan *http.Request)},
+		config:        cfg,
+		source:        source,
+		eventChan:     make(chan Event),
+		subscriptions: newSubscriptions(),
+		stats:         &pipelineStats{},
+		stopping:      make(chan struct{}),
 	}
+	s.factory = newStreamFactory(cfg, s.eventChan, s.stats, s.reportError)
 
 	streamPool := tcpassembly.NewStreamPool(s.factory)
 	s.assembler = tcpassembly.NewAssembler(streamPool)
@@ -37,101 +65,341 @@ func newSniffer(cfg Cfg) *sniffer {
 	return s
 }
 
-func (s *sniffer) AddHandler(handler Handler) error {
-	s.handlers = append(s.handlers, handler)
+func (s *sniffer) AddHandler(handler Handler, opts ...HandlerOption) error {
+	return s.addHandler(httpEventHandler(handler), isHTTPRequestEvent, opts...)
+}
+
+func (s *sniffer) AddEventHandler(handler EventHandler, opts ...HandlerOption) error {
+	return s.addHandler(handler, nil, opts...)
+}
+
+// addHandler registers a handler for the events accept returns true for, or every event if accept is nil.
+func (s *sniffer) addHandler(
+	handler EventHandler, accept func(event Event) bool, opts ...HandlerOption,
+) error {
+	name := fmt.Sprintf("handler-%d", len(s.handlers))
+	queue := newHandlerQueue(name, handler, opts...)
+	queue.accept = accept
+
+	if filter := queue.options.filter; filter != nil {
+		queue.accept = func(event Event) bool {
+			return (accept == nil || accept(event)) && filter(event)
+		}
+	}
+
+	queue.report = s.reportError
+	s.handlers = append(s.handlers, queue)
 
 	return nil
 }
 
-const maxSnapLen = 65536
+func (s *sniffer) Subscribe(bufferSize int, filter func(event Event) bool) *Subscription {
+	return s.subscriptions.add(bufferSize, filter)
+}
+
+func (s *sniffer) HandlerStats() []HandlerStats {
+	stats := make([]HandlerStats, 0, len(s.handlers))
+	for _, handler := range s.handlers {
+		stats = append(stats, handler.stats())
+	}
+
+	return stats
+}
+
+func (s *sniffer) SetErrorHandler(handler ErrorHandler) {
+	s.errorHandler = handler
+}
+
+func (s *sniffer) ReportError(event *ErrorEvent) {
+	s.reportError(event)
+}
+
+func (s *sniffer) Stats() Stats {
+	stats := s.stats.load()
+	stats.Handlers = s.HandlerStats()
+
+	s.captureSourceMu.Lock()
+	source, ok := s.captureSource.(StatsSource)
+	s.captureSourceMu.Unlock()
+
+	if ok {
+		// capture counters are best effort, a closed source may not report them anymore
+		if capture, err := source.CaptureStats(); err == nil {
+			stats.Capture = capture
+		}
+	}
 
-const timeoutDuration = time.Second * 3
+	return stats
+}
 
 func (s *sniffer) readPackets(
-	ctx context.Context, packets chan gopacket.Packet,
-) {
+	ctx context.Context, packets chan gopacket.Packet, clock *replayClock,
+) bool {
 	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	defragmenter := ip4defrag.NewIPv4Defragmenter()
 
 	for {
 		select {
 		case <-ctx.Done():
-			return
-		case packet := <-packets:
+			return false
+		case <-s.stopping:
+			return s.flush(ctx)
+		case packet, ok := <-packets:
+			if !ok {
+				return s.flush(ctx)
+			}
+
+			// replayed packets wait until they are due, the loop then sees why the wait is cut short
+			if clock != nil && !clock.wait(ctx, s.stopping, packet.Metadata().Timestamp) {
+				continue
+			}
+
 			var (
 				tcp         *layers.TCP
 				networkFlow gopacket.Flow
 				err         error
 			)
 
+			// fragments are held back until the whole datagram is reassembled
+			packet, err = defragment(defragmenter, packet)
+			if err != nil {
+				atomic.AddUint64(&s.stats.packetsInvalid, 1)
+
+				continue
+			}
+
+			if packet == nil {
+				continue
+			}
+
 			// handle vxlan configuration
 			networkFlow, tcp, err = s.handleVXLAN(packet)
 			if tcp == nil || err != nil {
+				s.countSkipped(packet)
+
 				continue
 			}
 
+			atomic.AddUint64(&s.stats.packetsDecoded, 1)
+
 			s.assembler.AssembleWithTimestamp(
 				networkFlow, tcp, packet.Metadata().Timestamp,
 			)
 
 		case <-ticker.C:
 			// Every minute, flush connections that haven't seen activity in the past 2 seconds.
-			s.assembler.FlushOlderThan(time.Now().Add(time.Second * -2))
+			now := time.Now()
+			if clock != nil {
+				// replayed streams are timed by the capture, which may be long ago
+				now = clock.now()
+			}
+
+			_, closed := s.assembler.FlushOlderThan(now.Add(time.Second * -2))
+			atomic.AddUint64(&s.stats.flushedStreams, uint64(closed))
+			// and forget the fragments of datagrams that never completed, which are timed by the capture too
+			defragmenter.DiscardOlderThan(now.Add(time.Second * -30))
 		}
 	}
 }
 
-func (s *sniffer) Run(ctx context.Context) error {
-	var (
-		handle *pcap.Handle
-		err    error
-	)
+// flush closes the remaining streams so that their last messages are decoded too, once there are no more
+// packets to read. It returns false if ctx is done before every stream is decoded.
+func (s *sniffer) flush(ctx context.Context) bool {
+	closed := s.assembler.FlushAll()
+	atomic.AddUint64(&s.stats.flushedStreams, uint64(closed))
 
-	switch s.config.IsLive {
-	case true:
-		handle, err = pcap.OpenLive(
-			s.config.InterfaceName, maxSnapLen, false, timeoutDuration,
-		)
-	case false:
-		handle, err = pcap.OpenOffline(s.config.PcapPath)
+	return s.factory.wait(ctx)
+}
+
+// countSkipped counts a packet that is not handed to the tcp reassembly.
+func (s *sniffer) countSkipped(packet gopacket.Packet) {
+	if packet.ErrorLayer() != nil {
+		atomic.AddUint64(&s.stats.packetsInvalid, 1)
+
+		return
 	}
 
-	if err != nil {
-		return errors.Wrap(err, "failed to open packet capture")
+	atomic.AddUint64(&s.stats.packetsNonTCP, 1)
+}
+
+// openSource returns the packet source of the sniffer, or opens the interface or pcap file in the
+// config if there is none. The returned function closes what is opened.
+func (s *sniffer) openSource() (PacketSource, func(), error) {
+	if s.source == nil {
+		source, closeSource, err := openPcap(s.config)
+		if err == nil {
+			s.setCaptureSource(source)
+		}
+
+		return source, closeSource, err
 	}
 
-	if err := handle.SetBPFFilter(s.config.Filter); err != nil {
-		return errors.WithMessagef(err, "failed to set bpf filter \"%s\"", s.config.Filter)
+	s.setCaptureSource(s.source)
+
+	if s.config.Filter == "" {
+		return s.source, func() {}, nil
 	}
 
-	defer handle.Close()
+	source, err := filterSource(s.source, s.config.Filter)
 
-	// Loop through packets
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	packets := packetSource.Packets()
+	return source, func() {}, err
+}
 
+func (s *sniffer) setCaptureSource(source PacketSource) {
+	s.captureSourceMu.Lock()
+	defer s.captureSourceMu.Unlock()
+
+	s.captureSource = source
+}
+
+func (s *sniffer) Run(ctx context.Context) error {
 	// start collecting packets
 	readCtx, readCancel := context.WithCancel(ctx)
+	defer readCancel()
+
+	runDone := make(chan struct{})
+	defer close(runDone)
+
+	s.runMu.Lock()
+	s.cancelRun, s.runDone = readCancel, runDone
+	s.runMu.Unlock()
+
+	if err := s.config.Replay.validate(); err != nil {
+		return err
+	}
+
+	source, closeSource, err := s.openSource()
+	if err != nil {
+		return err
+	}
+
+	defer closeSource()
+
+	// Loop through packets
+	packetSource := gopacket.NewPacketSource(source, source.LinkType())
+	packets := packetSource.Packets()
+
+	// exhausted is closed once the source has no more packets and every stream is decoded
+	exhausted := make(chan struct{})
+
+	var (
+		clock   *replayClock
+		limiter *rateLimiter
+	)
+
+	// live captures are paced by the network
+	if !s.config.IsLive && s.config.Replay.Speed > 0 {
+		clock = &replayClock{speed: s.config.Replay.Speed}
+	}
+
+	if !s.config.IsLive && s.config.Replay.RequestsPerSecond > 0 {
+		limiter = newRateLimiter(s.config.Replay.RequestsPerSecond)
+	}
 
 	go func() {
-		s.readPackets(ctx, packets)
-		readCancel()
+		if s.readPackets(readCtx, packets, clock) {
+			close(exhausted)
+		}
 	}()
 
 	// start consuming deliveries
-	return s.handleAssembledRequests(readCtx)
+	return s.handleAssembledRequests(readCtx, exhausted, limiter)
 }
 
-func (s *sniffer) handleAssembledRequests(readCtx context.Context) error {
+func (s *sniffer) Shutdown(ctx context.Context) error {
+	s.stopOnce.Do(
+		func() {
+			close(s.stopping)
+		},
+	)
+
+	s.runMu.Lock()
+	cancelRun, runDone := s.cancelRun, s.runDone
+	s.runMu.Unlock()
+
+	if runDone == nil {
+		return nil
+	}
+
+	select {
+	case <-runDone:
+		return nil
+	case <-ctx.Done():
+		// out of time, stop the handlers without waiting for the queued events
+		cancelRun()
+		<-runDone
+
+		return ctx.Err()
+	}
+}
+
+// handleAssembledRequests hands the events to the handlers until the source is exhausted. Requests are
+// handed at the rate of limiter, if it is set.
+func (s *sniffer) handleAssembledRequests(
+	readCtx context.Context, exhausted chan struct{}, limiter *rateLimiter,
+) error {
+	var (
+		wg         sync.WaitGroup
+		handlerErr error
+		failOnce   sync.Once
+	)
+
+	defer s.subscriptions.closeAll()
+
+	handlerCtx, cancelHandlers := context.WithCancel(readCtx)
+
+	// stop the workers and wait for the handlers that are still running
+	stop := func() error {
+		cancelHandlers()
+		wg.Wait()
+
+		return handlerErr
+	}
+
+	fail := func(err error) {
+		failOnce.Do(
+			func() {
+				handlerErr = err
+				cancelHandlers()
+			},
+		)
+	}
+
+	for _, handler := range s.handlers {
+		if err := handler.start(handlerCtx, &wg, fail); err != nil {
+			_ = stop()
+
+			return err
+		}
+	}
+
 	for {
 		select {
-		case <-readCtx.Done():
-			return nil
+		case <-handlerCtx.Done():
+			return stop()
+
+		case <-exhausted:
+			// there will be no more events, let the handlers finish the queued ones
+			for _, handler := range s.handlers {
+				handler.drain(handlerCtx)
+			}
+
+			return stop()
+
+		// 	queue packets for the handlers.
+		case event := <-s.eventChan:
+			if limiter != nil && isHTTPRequestEvent(event) && !limiter.wait(handlerCtx, s.stopping) {
+				return stop()
+			}
+
+			atomic.AddUint64(&s.stats.eventsEmitted, 1)
+			s.subscriptions.publish(event)
 
-		// 	run handlers on packets.
-		case req := <-s.factory.requestChan:
 			for _, handler := range s.handlers {
-				if err := handler(context.Background(), req); err != nil {
-					return err
+				if !handler.push(handlerCtx, event) {
+					break
 				}
 			}
 		}
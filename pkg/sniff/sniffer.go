@@ -2,8 +2,15 @@ package sniff
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/strixeyecom/gniffer/pkg/filter"
+	"github.com/strixeyecom/gniffer/pkg/shadow"
 )
 
 /*
@@ -21,12 +28,45 @@ type Handler func(ctx context.Context, req *http.Request) error
 // Sniffer should be implemented by structs that wants to use the underlying gniffer logic.
 type Sniffer interface {
 	Run(ctx context.Context) error
-	AddHandler(handler Handler) error
+	// Shutdown stops capturing packets, flushes the streams that are being reassembled and waits until
+	// the handlers finish the queued events, when Run returns. If ctx is done first, the handlers are
+	// stopped without finishing the queued events and the error of ctx is returned. A sniffer that is
+	// shut down does not capture again.
+	Shutdown(ctx context.Context) error
+	// AddHandler registers a handler for http requests. Every handler runs on its own workers, which are
+	// configured by opts.
+	AddHandler(handler Handler, opts ...HandlerOption) error
+	// AddEventHandler registers a handler for every decoded event, including the non http ones such as
+	// mqtt packets. WithEventFilter narrows it down to the events the handler is interested in.
+	AddEventHandler(handler EventHandler, opts ...HandlerOption) error
+	// Subscribe returns a subscription that receives the decoded events passing filter, or every event if
+	// filter is nil, on a channel with bufferSize buffer. Events are dropped for the subscription when its
+	// buffer is full. Subscriptions can be added and removed while the sniffer is running, and they are
+	// closed when it stops.
+	Subscribe(bufferSize int, filter func(event Event) bool) *Subscription
+	// HandlerStats returns the queue counters of the handlers, in the order they are added.
+	HandlerStats() []HandlerStats
+	// Stats returns the counters of the whole sniffer, from the packet capture to the handlers. It is safe
+	// to call while the sniffer is running.
+	Stats() Stats
+	// SetErrorHandler sets the handler of error events, which are logged when there is no handler. A
+	// stream or handler that fails is reported as an error event and the sniffer keeps running. It should
+	// be called before Run.
+	SetErrorHandler(handler ErrorHandler)
+	// ReportError reports an error of the work done for an event outside the sniffer, such as sending a
+	// request somewhere, so that it is counted in the stats and passed to the error handler.
+	ReportError(event *ErrorEvent)
 }
 
 // New is a factory method for creating a new sniffer.
 func New(cfg Cfg) Sniffer {
-	return newSniffer(cfg)
+	return newSniffer(cfg, nil)
+}
+
+// NewWithSource creates a sniffer that reads packets from source instead of the interface or pcap file in
+// cfg. The bpf filter of cfg still applies to the packets of source.
+func NewWithSource(cfg Cfg, source PacketSource) Sniffer {
+	return newSniffer(cfg, source)
 }
 
 // Cfg is the configuration for the sniffer. It keeps basic information,
@@ -47,6 +87,11 @@ type Cfg struct {
 	Filter string `json:"filter" mapstructure:"FILTER"`
 	// 	PcapPath is the path to the pcap file to write to. It can either be a sniffer or pcap.
 	PcapPath string `json:"pcap_path" mapstructure:"PCAP_PATH"`
+	// MQTTPorts are the tcp ports whose streams are decoded as mqtt instead of http. Either side of the
+	// connection using one of the ports is enough, so both client and broker packets are decoded.
+	MQTTPorts []int `json:"mqtt_ports" mapstructure:"MQTT_PORTS"`
+	// Replay configures the pace packets are read at when the sniffer is not live.
+	Replay ReplayCfg `json:"replay" mapstructure:"REPLAY"`
 }
 
 // ProxyCfg is the configuration for the proxy.
@@ -55,39 +100,313 @@ type Cfg struct {
 type ProxyCfg struct {
 	// Cfg is the configuration for the gniffer application.
 	Cfg Cfg `json:"cfg" mapstructure:"CFG"`
+	// Targets are the destinations the proxy mirrors requests to. When it is empty, requests are mirrored
+	// to the single target of TargetProtocol, TargetHost and TargetPort.
+	Targets []TargetCfg `json:"targets" mapstructure:"TARGETS"`
 	// TargetProtocol http or https
 	TargetProtocol string `json:"target_protocol" mapstructure:"TARGET_PROTOCOL"`
 	// TargetHost should be a valid hostname
 	TargetHost string `json:"target_host" mapstructure:"TARGET_HOST"`
 	// TargetPort should be a valid port
 	TargetPort string `json:"target_port" mapstructure:"TARGET_PORT"`
+	// TargetHTTPVersion is the http version of the single target, see TargetCfg.HTTPVersion.
+	TargetHTTPVersion string `json:"target_http_version" mapstructure:"TARGET_HTTP_VERSION"`
 	// 	HTTPFilter supports filtering of http requests. In Cfg, the filter works at the network layer,
 	// 	this is the filter applied to the application layer.
 	HTTPFilter *HTTPFilter `json:"http_filter" mapstructure:"HTTP_FILTER"`
+	// Sampling configures which share of the requests that pass HTTPFilter are handled.
+	Sampling SamplingCfg `json:"sampling" mapstructure:"SAMPLING"`
+	// Rewrite are the rules that change the requests sent to every target, before the rules of the target.
+	Rewrite []RewriteRule `json:"rewrite" mapstructure:"REWRITE"`
+	// Credentials substitutes the credentials of the requests sent to the targets.
+	Credentials CredentialsCfg `json:"credentials" mapstructure:"CREDENTIALS"`
+	// Amplify sends copies of the requests to the targets.
+	Amplify AmplifyCfg `json:"amplify" mapstructure:"AMPLIFY"`
+	// TLS configures the connections to the https targets.
+	TLS TLSCfg `json:"tls" mapstructure:"TLS"`
+	// Retry configures the retries of the requests sent to the targets.
+	Retry RetryCfg `json:"retry" mapstructure:"RETRY"`
+	// CircuitBreaker configures the circuit breakers that stop sending requests to failing targets.
+	CircuitBreaker BreakerCfg `json:"circuit_breaker" mapstructure:"CIRCUIT_BREAKER"`
+	// PreserveConnections sends the requests of every captured client connection over a connection of their
+	// own to the targets, in the order they are captured, instead of spreading them over the workers.
+	PreserveConnections bool `json:"preserve_connections" mapstructure:"PRESERVE_CONNECTIONS"`
+	// DiskQueue configures the durable queues that keep the requests of the targets on disk until they are
+	// sent.
+	DiskQueue DiskQueueCfg `json:"disk_queue" mapstructure:"DISK_QUEUE"`
 	// AppendXFF is true if the X-Forwarded-For header should be added to the request. (default: false)
 	// Also overrides X-Forwarded-Port header.
 	AppendXFF bool `json:"append_xff" mapstructure:"APPEND_XFF"`
 	// EnableOriginHeaders is true if the Gniffer-Connecting-IP /PORT headers should be added to the request.
 	// (default: false)
 	EnableOriginHeaders bool `json:"enable_origin_headers" mapstructure:"ENABLE_ORIGIN_HEADERS"`
+	// Queue configures the queue between the sniffer and the handlers of the command.
+	Queue QueueCfg `json:"queue" mapstructure:"QUEUE"`
+	// Errors configures what happens when a handler of the command fails.
+	Errors ErrorCfg `json:"errors" mapstructure:"ERRORS"`
+	// StatsInterval is how often the command logs the counters of the sniffer, 0 disables the stats lines.
+	StatsInterval time.Duration `json:"stats_interval" mapstructure:"STATS_INTERVAL"`
+	// MetricsListen is the address the command serves prometheus metrics on at /metrics, empty disables it.
+	MetricsListen string `json:"metrics_listen" mapstructure:"METRICS_LISTEN"`
+	// ShutdownTimeout is how long the command waits for the queued requests to be handled after it is
+	// asked to shut down.
+	ShutdownTimeout time.Duration `json:"shutdown_timeout" mapstructure:"SHUTDOWN_TIMEOUT"`
+}
+
+// ProxyTargets returns Targets, or a single target named proxy made of TargetProtocol, TargetHost and
+// TargetPort when there are no Targets. Targets without a name are named by their position.
+func (c ProxyCfg) ProxyTargets() ([]TargetCfg, error) {
+	if len(c.Targets) == 0 {
+		if c.TargetPort == "" {
+			return nil, errors.New("target port is required")
+		}
+
+		return []TargetCfg{
+			{
+				Name: "proxy", Protocol: c.TargetProtocol, Host: c.TargetHost, Port: c.TargetPort,
+				HTTPVersion: c.TargetHTTPVersion,
+			},
+		}, nil
+	}
+
+	targets := make([]TargetCfg, len(c.Targets))
+	names := make(map[string]bool, len(c.Targets))
+
+	for i, target := range c.Targets {
+		if target.Name == "" {
+			target.Name = fmt.Sprintf("target-%d", i)
+		}
+
+		if names[target.Name] {
+			return nil, errors.Errorf("target name %q is used more than once", target.Name)
+		}
+
+		names[target.Name] = true
+
+		if target.Host == "" || target.Port == "" {
+			return nil, errors.Errorf("target %s needs a host and a port", target.Name)
+		}
+
+		targets[i] = target
+	}
+
+	return targets, nil
+}
+
+// TargetCfg is a destination the proxy mirrors requests to.
+type TargetCfg struct {
+	// Name is what the target is reported with in logs, stats and metrics.
+	Name string `json:"name" mapstructure:"NAME"`
+	// Protocol is http or https. (default: http)
+	Protocol string `json:"protocol" mapstructure:"PROTOCOL"`
+	Host     string `json:"host" mapstructure:"HOST"`
+	Port     string `json:"port" mapstructure:"PORT"`
+	// HTTPVersion is the http version requests are sent with: 1.1, 2 for http/2 over tls with the https
+	// protocol, or h2c for http/2 without tls with the http protocol, which the target has to know it
+	// speaks. Requests are sent as they are captured, so grpc requests captured from h2c connections can be
+	// sent to h2c or http/2 targets. (default: 1.1)
+	HTTPVersion string `json:"http_version" mapstructure:"HTTP_VERSION"`
+	// HTTPFilter narrows the requests of the target down from the ones passing the filter of the proxy.
+	HTTPFilter *HTTPFilter `json:"http_filter" mapstructure:"HTTP_FILTER"`
+	// Sampling replaces the sampling of the proxy for the target, if it is set.
+	Sampling *SamplingCfg `json:"sampling" mapstructure:"SAMPLING"`
+	// Headers are changed on the requests sent to the target.
+	Headers HeaderRewriteCfg `json:"headers" mapstructure:"HEADERS"`
+	// Rewrite are the rules that change the requests sent to the target, after Headers and the rules of the
+	// proxy.
+	Rewrite []RewriteRule `json:"rewrite" mapstructure:"REWRITE"`
+	// Credentials replaces the credential substitution of the proxy for the target, if it is set.
+	Credentials *CredentialsCfg `json:"credentials" mapstructure:"CREDENTIALS"`
+	// Amplify replaces the amplification of the proxy for the target, if it is set.
+	Amplify *AmplifyCfg `json:"amplify" mapstructure:"AMPLIFY"`
+	// TLS replaces the tls configuration of the proxy for the target, if it is set.
+	TLS *TLSCfg `json:"tls" mapstructure:"TLS"`
+	// Retry replaces the retries of the proxy for the target, if it is set.
+	Retry *RetryCfg `json:"retry" mapstructure:"RETRY"`
+	// CircuitBreaker replaces the circuit breaker of the proxy for the target, if it is set.
+	CircuitBreaker *BreakerCfg `json:"circuit_breaker" mapstructure:"CIRCUIT_BREAKER"`
+	// PreserveConnections replaces the connection mapping of the proxy for the target, if it is set.
+	PreserveConnections *bool `json:"preserve_connections" mapstructure:"PRESERVE_CONNECTIONS"`
+	// DiskQueue replaces the durable queue of the proxy for the target, if it is set.
+	DiskQueue *DiskQueueCfg `json:"disk_queue" mapstructure:"DISK_QUEUE"`
+	// Timeout is the time limit of the requests sent to the target. (default: 20s)
+	Timeout time.Duration `json:"timeout" mapstructure:"TIMEOUT"`
+	// Workers is the number of requests sent to the target at the same time. (default: 2000)
+	Workers int `json:"workers" mapstructure:"WORKERS"`
+	// Compare compares the responses of the target with the production responses, if it is set.
+	Compare *shadow.Config `json:"compare" mapstructure:"COMPARE"`
+}
+
+// HeaderRewriteCfg changes the headers of requests. Headers are removed first, then set, then added.
+type HeaderRewriteCfg struct {
+	// Set replaces the values of the headers.
+	Set map[string]string `json:"set" mapstructure:"SET"`
+	// Add adds a value to the headers, keeping the values they already have.
+	Add map[string]string `json:"add" mapstructure:"ADD"`
+	// Remove deletes the headers.
+	Remove []string `json:"remove" mapstructure:"REMOVE"`
+}
+
+// Apply changes header as configured.
+func (c HeaderRewriteCfg) Apply(header http.Header) {
+	for _, name := range c.Remove {
+		header.Del(name)
+	}
+
+	for name, value := range c.Set {
+		header.Set(name, value)
+	}
+
+	for name, value := range c.Add {
+		header.Add(name, value)
+	}
+}
+
+// QueueCfg configures the queue that buffers events for a handler.
+type QueueCfg struct {
+	// Size is the number of events buffered for the handler before the overflow policy applies.
+	Size int `json:"size" mapstructure:"SIZE"`
+	// OverflowPolicy is one of block, drop-newest, drop-oldest or spill. (default: block)
+	OverflowPolicy string `json:"overflow_policy" mapstructure:"OVERFLOW_POLICY"`
+	// SpillDir is the directory the spill policy writes events to. (default: os.TempDir())
+	SpillDir string `json:"spill_dir" mapstructure:"SPILL_DIR"`
+}
+
+// HandlerOptions returns the handler options for the queue configuration.
+func (c QueueCfg) HandlerOptions() ([]HandlerOption, error) {
+	opts := []HandlerOption{WithQueueSize(c.Size)}
+
+	if c.OverflowPolicy != "" {
+		policy, err := ParseOverflowPolicy(c.OverflowPolicy)
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, WithOverflowPolicy(policy))
+	}
+
+	if c.SpillDir != "" {
+		opts = append(opts, WithSpillDir(c.SpillDir))
+	}
+
+	return opts, nil
 }
 
 // HTTPFilter supports filtering of http requests. In Cfg, the filter works at the network layer,
 // 	this is the filter applied to the application layer.
 type HTTPFilter struct {
 	Hostname string `json:"server_host" mapstructure:"HOSTNAME"`
+	// Expression is a pkg/filter expression requests should match, such as
+	// `method == "POST" && path.glob("/api/v2/*") && !src_ip.inCIDR("10.0.0.0/8")`.
+	Expression string `json:"expression" mapstructure:"EXPRESSION"`
 }
 
-// Match implements the application layer filtering mechanism similar to the bpf filter in Cfg.
+// Matcher compiles the filter into the application layer filtering mechanism similar to the bpf filter
+// in Cfg. Requests match when they match both the hostname and the expression.
+func (f HTTPFilter) Matcher() (func(req *http.Request) bool, error) {
+	var expr *filter.Filter
+
+	if f.Expression != "" {
+		var err error
+
+		expr, err = filter.Compile(f.Expression)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid http filter")
+		}
+	}
+
+	return func(req *http.Request) bool {
+		if f.Hostname != "" && hostOf(req) != f.Hostname {
+			return false
+		}
+
+		return expr == nil || expr.Match(filterInput(req))
+	}, nil
+}
+
+// compiledExpressions caches the expressions compiled by HTTPFilter.Match, which can not keep them in the
+// filter itself.
+var compiledExpressions sync.Map
+
+// Match implements the application layer filtering mechanism similar to the bpf filter in Cfg. The
+// expression is compiled once on first use, and an expression that does not compile is ignored, so that
+// only the hostname is matched.
+//
+// Deprecated: Matcher reports invalid expressions and does not look the expression up for every request.
 func (f HTTPFilter) Match(req *http.Request) bool {
+	if f.Hostname != "" && hostOf(req) != f.Hostname {
+		return false
+	}
+
+	if f.Expression == "" {
+		return true
+	}
+
+	compiled, ok := compiledExpressions.Load(f.Expression)
+	if !ok {
+		expr, err := filter.Compile(f.Expression)
+		if err != nil {
+			expr = nil
+		}
+
+		compiled, _ = compiledExpressions.LoadOrStore(f.Expression, expr)
+	}
+
+	expr := compiled.(*filter.Filter)
+
+	return expr == nil || expr.Match(filterInput(req))
+}
+
+func hostOf(req *http.Request) string {
 	host, _, err := net.SplitHostPort(req.Host)
 	if err != nil {
-		host = req.Host
+		return req.Host
 	}
 
-	if f.Hostname != "" && host != f.Hostname {
-		return false
+	return host
+}
+
+// filterInput returns the filter input of a request, with the addresses of its connection if the
+// request is handed to a Handler by the sniffer.
+func filterInput(req *http.Request) filter.Input {
+	input := filter.Input{Request: req}
+
+	if flow, ok := RequestFlow(req); ok {
+		srcPort, dstPort := flow.Transport.Endpoints()
+
+		input.SrcIP = net.IP(flow.Net.Src().Raw())
+		input.SrcPort = int(portOf(srcPort))
+		input.DstIP = net.IP(flow.Net.Dst().Raw())
+		input.DstPort = int(portOf(dstPort))
+	}
+
+	return input
+}
+
+// ErrorCfg configures what happens when a handler returns an error.
+type ErrorCfg struct {
+	// Policy is one of stop, ignore, log or retry. (default: stop)
+	Policy string `json:"policy" mapstructure:"POLICY"`
+	// Retries is the number of retries of the retry policy.
+	Retries int `json:"retries" mapstructure:"RETRIES"`
+	// RetryBackoff is the wait before the first retry, doubled for every following one.
+	RetryBackoff time.Duration `json:"retry_backoff" mapstructure:"RETRY_BACKOFF"`
+}
+
+// HandlerOptions returns the handler options for the error configuration.
+func (c ErrorCfg) HandlerOptions() ([]HandlerOption, error) {
+	if c.Policy == "" {
+		return nil, nil
+	}
+
+	policy, err := ParseErrorPolicy(c.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	if policy == ErrorRetry {
+		return []HandlerOption{WithRetry(c.Retries, c.RetryBackoff)}, nil
 	}
 
-	return true
+	return []HandlerOption{WithErrorPolicy(policy)}, nil
 }
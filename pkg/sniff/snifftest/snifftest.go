@@ -0,0 +1,576 @@
+// Package snifftest builds synthetic packet captures of tcp conversations, so that handlers of the
+// sniffer can be tested against realistic input without a network interface or a pcap file.
+//
+// A conversation is scripted with the payloads each side sends, and turned into packets with the tcp
+// handshake, segmenting, and optionally vxlan wrapping, ip fragmentation, loss, retransmissions and
+// reordering:
+//
+//	conv, err := snifftest.NewConversation("10.0.0.1:40000", "10.0.0.2:80", snifftest.Options{MSS: 100})
+//	conv.Exchange(req, resp)
+//	packets, err := conv.Packets()
+//	recorder, err := snifftest.Run(ctx, sniff.Cfg{}, packets)
+package snifftest
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pkg/errors"
+	"github.com/strixeyecom/gniffer/pkg/sniff"
+)
+
+const (
+	// DefaultMSS is the segment size used when Options.MSS is not set.
+	DefaultMSS = 1460
+	// DefaultInterval is the time between packets used when Options.Interval is not set.
+	DefaultInterval = time.Millisecond
+	// VXLANPort is the udp port vxlan wrapped packets are sent to.
+	VXLANPort = 4789
+
+	minFragmentSize = 16
+)
+
+var (
+	clientMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	serverMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	// vtep addresses of the outer packets of vxlan wrapped conversations
+	clientVTEP = net.IPv4(192, 0, 2, 1)
+	serverVTEP = net.IPv4(192, 0, 2, 2)
+)
+
+// Packet is a packet of a synthetic capture, in the format sniff.InjectedSource accepts.
+type Packet struct {
+	Data        []byte
+	CaptureInfo gopacket.CaptureInfo
+}
+
+// Options change how the packets of a conversation are built. The zero value builds a clean capture.
+type Options struct {
+	// MSS is the maximum payload size of a tcp segment.
+	MSS int
+	// VXLAN wraps every packet in a vxlan tunnel with the VNI.
+	VXLAN bool
+	VNI   uint32
+	// FragmentSize splits the ipv4 packets with a larger payload into fragments of at most
+	// FragmentSize bytes of payload. It is rounded down to a multiple of 8, and it is at least 16 so that
+	// no fragment is smaller than 8 bytes. ipv6 packets are never fragmented. For vxlan wrapped
+	// conversations, the outer packets are fragmented.
+	FragmentSize int
+	// Loss is the probability of a data segment to never be sent, between 0 and 1.
+	Loss float64
+	// Retransmit is the probability of a data segment to be sent twice, between 0 and 1.
+	Retransmit float64
+	// Reorder is the probability of a packet to swap places with the one after it, between 0 and 1.
+	Reorder float64
+	// Seed seeds the random decisions of Loss, Retransmit and Reorder, so that captures are reproducible.
+	Seed int64
+	// Start is the timestamp of the first packet, time.Now() when it is zero.
+	Start time.Time
+	// Interval is the time between two packets.
+	Interval time.Duration
+}
+
+// direction of a payload in a conversation
+type direction int
+
+const (
+	toServer direction = iota
+	toClient
+)
+
+type message struct {
+	dir     direction
+	payload []byte
+}
+
+// Conversation is the script of a tcp connection between a client and a server. Its methods append
+// messages to the script and can be chained, the first error is returned by Packets.
+type Conversation struct {
+	client, server *net.TCPAddr
+	opts           Options
+	messages       []message
+	err            error
+	// ipID numbers the ipv4 packets, so that the fragments of different packets are not mixed up
+	ipID uint16
+}
+
+// NewConversation scripts a connection from the client to the server address, both given as host:port.
+// Both addresses must be of the same ip version.
+func NewConversation(client, server string, opts Options) (*Conversation, error) {
+	clientAddr, err := resolve(client)
+	if err != nil {
+		return nil, err
+	}
+
+	serverAddr, err := resolve(server)
+	if err != nil {
+		return nil, err
+	}
+
+	if (clientAddr.IP.To4() == nil) != (serverAddr.IP.To4() == nil) {
+		return nil, errors.Errorf("client %s and server %s are of different ip versions", client, server)
+	}
+
+	if opts.MSS <= 0 {
+		opts.MSS = DefaultMSS
+	}
+
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+
+	return &Conversation{client: clientAddr, server: serverAddr, opts: opts}, nil
+}
+
+func resolve(addr string) (*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid address %s", addr)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.Errorf("invalid ip in address %s", addr)
+	}
+
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid port in address %s", addr)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(portNumber)}, nil
+}
+
+// Send appends a payload the client sends to the server.
+func (c *Conversation) Send(payload []byte) *Conversation {
+	c.messages = append(c.messages, message{dir: toServer, payload: payload})
+
+	return c
+}
+
+// Reply appends a payload the server sends to the client.
+func (c *Conversation) Reply(payload []byte) *Conversation {
+	c.messages = append(c.messages, message{dir: toClient, payload: payload})
+
+	return c
+}
+
+// Request appends an http request the client sends, in wire format.
+func (c *Conversation) Request(req *http.Request) *Conversation {
+	var buf bytes.Buffer
+
+	if err := req.Write(&buf); err != nil && c.err == nil {
+		c.err = errors.Wrap(err, "failed to write request")
+	}
+
+	return c.Send(buf.Bytes())
+}
+
+// Response appends an http response the server sends, in wire format.
+func (c *Conversation) Response(resp *http.Response) *Conversation {
+	var buf bytes.Buffer
+
+	if err := resp.Write(&buf); err != nil && c.err == nil {
+		c.err = errors.Wrap(err, "failed to write response")
+	}
+
+	return c.Reply(buf.Bytes())
+}
+
+// Exchange appends a request and its response.
+func (c *Conversation) Exchange(req *http.Request, resp *http.Response) *Conversation {
+	return c.Request(req).Response(resp)
+}
+
+// endpoint is the sending side of a segment.
+type endpoint struct {
+	addr *net.TCPAddr
+	mac  net.HardwareAddr
+	vtep net.IP
+	seq  uint32
+}
+
+// Packets builds the capture of the conversation: the handshake, the scripted payloads in segments of
+// at most MSS bytes, and the closing of the connection by both sides.
+func (c *Conversation) Packets() ([]Packet, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	rnd := rand.New(rand.NewSource(c.opts.Seed)) // nolint:gosec // reproducible, not secure
+	client := &endpoint{addr: c.client, mac: clientMAC, vtep: clientVTEP, seq: rnd.Uint32()}
+	server := &endpoint{addr: c.server, mac: serverMAC, vtep: serverVTEP, seq: rnd.Uint32()}
+
+	var frames [][]byte
+
+	emit := func(from, to *endpoint, flags tcpFlags, payload []byte) error {
+		built, err := c.frames(from, to, flags, payload)
+		if err != nil {
+			return err
+		}
+
+		frames = append(frames, built...)
+
+		return nil
+	}
+
+	// handshake, the syn and fin flags take a sequence number each
+	handshake := []struct {
+		from, to *endpoint
+		flags    tcpFlags
+	}{
+		{client, server, tcpFlags{syn: true}},
+		{server, client, tcpFlags{syn: true, ack: true}},
+		{client, server, tcpFlags{ack: true}},
+	}
+
+	for _, step := range handshake {
+		if err := emit(step.from, step.to, step.flags, nil); err != nil {
+			return nil, err
+		}
+
+		if step.flags.syn {
+			step.from.seq++
+		}
+	}
+
+	for _, msg := range c.messages {
+		from, to := client, server
+		if msg.dir == toClient {
+			from, to = server, client
+		}
+
+		for start := 0; start < len(msg.payload); start += c.opts.MSS {
+			end := start + c.opts.MSS
+			if end > len(msg.payload) {
+				end = len(msg.payload)
+			}
+
+			segment := msg.payload[start:end]
+
+			sends := 1
+			if rnd.Float64() < c.opts.Loss {
+				sends = 0
+			} else if rnd.Float64() < c.opts.Retransmit {
+				sends = 2
+			}
+
+			for i := 0; i < sends; i++ {
+				if err := emit(from, to, tcpFlags{ack: true, psh: true}, segment); err != nil {
+					return nil, err
+				}
+			}
+
+			from.seq += uint32(len(segment))
+		}
+	}
+
+	for _, side := range [][2]*endpoint{{client, server}, {server, client}} {
+		if err := emit(side[0], side[1], tcpFlags{fin: true, ack: true}, nil); err != nil {
+			return nil, err
+		}
+
+		side[0].seq++
+	}
+
+	for i := 0; i+1 < len(frames); i++ {
+		if rnd.Float64() < c.opts.Reorder {
+			frames[i], frames[i+1] = frames[i+1], frames[i]
+			// the swapped packet is not swapped again
+			i++
+		}
+	}
+
+	return c.timestamp(frames), nil
+}
+
+func (c *Conversation) timestamp(frames [][]byte) []Packet {
+	start := c.opts.Start
+	if start.IsZero() {
+		start = time.Now()
+	}
+
+	packets := make([]Packet, 0, len(frames))
+	for i, frame := range frames {
+		packets = append(
+			packets, Packet{
+				Data: frame,
+				CaptureInfo: gopacket.CaptureInfo{
+					Timestamp:     start.Add(time.Duration(i) * c.opts.Interval),
+					CaptureLength: len(frame),
+					Length:        len(frame),
+				},
+			},
+		)
+	}
+
+	return packets
+}
+
+type tcpFlags struct {
+	syn, ack, psh, fin bool
+}
+
+// frames encodes a tcp segment into the ethernet frames that carry it.
+func (c *Conversation) frames(from, to *endpoint, flags tcpFlags, payload []byte) ([][]byte, error) {
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(from.addr.Port),
+		DstPort: layers.TCPPort(to.addr.Port),
+		Seq:     from.seq,
+		SYN:     flags.syn,
+		ACK:     flags.ack,
+		PSH:     flags.psh,
+		FIN:     flags.fin,
+		Window:  65535,
+	}
+	if flags.ack {
+		tcp.Ack = to.seq
+	}
+
+	c.ipID++
+	ip, ethernetType := networkLayer(from.addr.IP, to.addr.IP, layers.IPProtocolTCP, c.ipID)
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, errors.Wrap(err, "failed to set network layer of tcp")
+	}
+
+	segment, err := serialize(tcp, gopacket.Payload(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.opts.VXLAN {
+		return c.ipFrames(from.mac, to.mac, ethernetType, ip, segment)
+	}
+
+	inner, err := serialize(
+		&layers.Ethernet{SrcMAC: from.mac, DstMAC: to.mac, EthernetType: ethernetType}, ip,
+		gopacket.Payload(segment),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	udp := &layers.UDP{SrcPort: layers.UDPPort(VXLANPort), DstPort: layers.UDPPort(VXLANPort)}
+	c.ipID++
+	outer, outerType := networkLayer(from.vtep, to.vtep, layers.IPProtocolUDP, c.ipID)
+
+	if err := udp.SetNetworkLayerForChecksum(outer); err != nil {
+		return nil, errors.Wrap(err, "failed to set network layer of udp")
+	}
+
+	datagram, err := serialize(
+		udp, &layers.VXLAN{ValidIDFlag: true, VNI: c.opts.VNI}, gopacket.Payload(inner),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.ipFrames(from.mac, to.mac, outerType, outer, datagram)
+}
+
+// ipFrames encodes the ip packet with the payload, fragmenting it if it is too large.
+func (c *Conversation) ipFrames(
+	src, dst net.HardwareAddr, ethernetType layers.EthernetType, ip ipLayer,
+	payload []byte,
+) ([][]byte, error) {
+	ethernet := &layers.Ethernet{SrcMAC: src, DstMAC: dst, EthernetType: ethernetType}
+	fragmentSize := c.opts.FragmentSize &^ 7
+	if fragmentSize > 0 && fragmentSize < minFragmentSize {
+		fragmentSize = minFragmentSize
+	}
+
+	ipv4, ok := ip.(*layers.IPv4)
+	if !ok || fragmentSize <= 0 || len(payload) <= fragmentSize {
+		frame, err := serialize(ethernet, ip, gopacket.Payload(payload))
+		if err != nil {
+			return nil, err
+		}
+
+		return [][]byte{frame}, nil
+	}
+
+	var frames [][]byte
+
+	for offset, end := 0, 0; offset < len(payload); offset = end {
+		end = offset + fragmentSize
+		// fragments smaller than 8 bytes are dropped as handcrafted, leave more for the last one
+		if rest := len(payload) - end; rest > 0 && rest < 8 {
+			end -= 8
+		}
+
+		fragment := *ipv4
+		fragment.FragOffset = uint16(offset / 8)
+
+		if end < len(payload) {
+			fragment.Flags |= layers.IPv4MoreFragments
+		} else {
+			end = len(payload)
+		}
+
+		frame, err := serialize(ethernet, &fragment, gopacket.Payload(payload[offset:end]))
+		if err != nil {
+			return nil, err
+		}
+
+		frames = append(frames, frame)
+	}
+
+	return frames, nil
+}
+
+// ipLayer is an ipv4 or ipv6 layer.
+type ipLayer interface {
+	gopacket.NetworkLayer
+	gopacket.SerializableLayer
+}
+
+func networkLayer(
+	src, dst net.IP, protocol layers.IPProtocol, id uint16,
+) (ipLayer, layers.EthernetType) {
+	if src4 := src.To4(); src4 != nil {
+		return &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Id:       id,
+			Protocol: protocol,
+			SrcIP:    src4,
+			DstIP:    dst.To4(),
+		}, layers.EthernetTypeIPv4
+	}
+
+	return &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: protocol,
+		SrcIP:      src,
+		DstIP:      dst,
+	}, layers.EthernetTypeIPv6
+}
+
+func serialize(stack ...gopacket.SerializableLayer) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+
+	if err := gopacket.SerializeLayers(buf, opts, stack...); err != nil {
+		return nil, errors.Wrap(err, "failed to encode packet")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Merge interleaves the packets of several captures by their timestamps, like a capture of concurrent
+// conversations would.
+func Merge(captures ...[]Packet) []Packet {
+	var merged []Packet
+	for _, packets := range captures {
+		merged = append(merged, packets...)
+	}
+
+	sort.SliceStable(
+		merged, func(i, j int) bool {
+			return merged[i].CaptureInfo.Timestamp.Before(merged[j].CaptureInfo.Timestamp)
+		},
+	)
+
+	return merged
+}
+
+// NewSniffer creates a sniffer that reads the packets and stops once they are all handled. Handlers are
+// added to it as usual before it is run.
+func NewSniffer(cfg sniff.Cfg, packets []Packet) (sniff.Sniffer, error) {
+	source := sniff.NewInjectedSource(layers.LinkTypeEthernet, len(packets))
+
+	for _, packet := range packets {
+		if err := source.Inject(packet.Data, packet.CaptureInfo); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := source.Close(); err != nil {
+		return nil, err
+	}
+
+	return sniff.NewWithSource(cfg, source), nil
+}
+
+// Run feeds the packets to a sniffer with cfg, and returns a recorder of the events it emits.
+func Run(ctx context.Context, cfg sniff.Cfg, packets []Packet) (*Recorder, error) {
+	sniffer, err := NewSniffer(cfg, packets)
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := &Recorder{}
+
+	err = sniffer.AddEventHandler(
+		recorder.Handle, sniff.WithName("recorder"), sniff.WithOrdering(sniff.OrderGlobal),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to add handler")
+	}
+
+	if err := sniffer.Run(ctx); err != nil {
+		return recorder, errors.Wrap(err, "failed to run sniffer")
+	}
+
+	return recorder, nil
+}
+
+// Recorder is an event handler that keeps the events it handles.
+type Recorder struct {
+	mu     sync.Mutex
+	events []sniff.Event
+}
+
+// Handle records the event, it is a sniff.EventHandler.
+func (r *Recorder) Handle(ctx context.Context, event sniff.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, event)
+
+	return nil
+}
+
+// Events returns the recorded events, in the order they are handled.
+func (r *Recorder) Events() []sniff.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]sniff.Event(nil), r.events...)
+}
+
+// Requests returns the recorded http requests.
+func (r *Recorder) Requests() []*http.Request {
+	var requests []*http.Request
+
+	for _, event := range r.Events() {
+		if httpEvent, ok := event.(*sniff.HTTPRequestEvent); ok {
+			requests = append(requests, httpEvent.Request)
+		}
+	}
+
+	return requests
+}
+
+// MQTTPackets returns the recorded mqtt packets.
+func (r *Recorder) MQTTPackets() []*sniff.MQTTPacket {
+	var packets []*sniff.MQTTPacket
+
+	for _, event := range r.Events() {
+		if mqttEvent, ok := event.(*sniff.MQTTEvent); ok {
+			packets = append(packets, mqttEvent.Packet)
+		}
+	}
+
+	return packets
+}
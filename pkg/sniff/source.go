@@ -0,0 +1,155 @@
+package sniff
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/pkg/errors"
+)
+
+/*
+	contains the packet sources the sniffer can read packets from
+*/
+
+// PacketSource is where the sniffer reads packets from. When ReadPacketData returns io.EOF, the sniffer
+// flushes the remaining streams, waits for the handlers to finish the queued events and returns.
+type PacketSource interface {
+	gopacket.PacketDataSource
+	// LinkType is the link layer type of the packets, used to decode them.
+	LinkType() layers.LinkType
+}
+
+// ErrSourceClosed is returned when packets are injected into a closed InjectedSource.
+var ErrSourceClosed = errors.New("packet source is closed")
+
+// pcapngMagic is the block type of the section header block every pcapng file starts with.
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+type dataSource struct {
+	gopacket.PacketDataSource
+	linkType layers.LinkType
+}
+
+func (s *dataSource) LinkType() layers.LinkType {
+	return s.linkType
+}
+
+// NewDataSource turns any packet data source into a packet source, whose packets are decoded as linkType.
+func NewDataSource(source gopacket.PacketDataSource, linkType layers.LinkType) PacketSource {
+	return &dataSource{PacketDataSource: source, linkType: linkType}
+}
+
+// NewReaderSource reads packets in pcap or pcapng format from r. The format is detected from the first
+// bytes of r.
+func NewReaderSource(r io.Reader) (PacketSource, error) {
+	buf := bufio.NewReader(r)
+
+	magic, err := buf.Peek(len(pcapngMagic))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read capture header")
+	}
+
+	if bytes.Equal(magic, pcapngMagic) {
+		reader, err := pcapgo.NewNgReader(buf, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read pcapng capture")
+		}
+
+		return reader, nil
+	}
+
+	reader, err := pcapgo.NewReader(buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read pcap capture")
+	}
+
+	return reader, nil
+}
+
+type injectedPacket struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+}
+
+// InjectedSource is a packet source that reads the packets injected into it, so that the sniffer can be
+// fed programmatically.
+type InjectedSource struct {
+	linkType  layers.LinkType
+	packets   chan injectedPacket
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewInjectedSource creates a packet source for injected packets of linkType. bufferSize packets can be
+// injected before Inject waits for the sniffer to read them.
+func NewInjectedSource(linkType layers.LinkType, bufferSize int) *InjectedSource {
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+
+	return &InjectedSource{
+		linkType: linkType,
+		packets:  make(chan injectedPacket, bufferSize),
+		done:     make(chan struct{}),
+	}
+}
+
+// Inject queues a packet for the sniffer. It returns ErrSourceClosed if the source is closed.
+func (s *InjectedSource) Inject(data []byte, ci gopacket.CaptureInfo) error {
+	select {
+	case <-s.done:
+		return ErrSourceClosed
+	default:
+	}
+
+	select {
+	case <-s.done:
+		return ErrSourceClosed
+	case s.packets <- injectedPacket{data: data, ci: ci}:
+		return nil
+	}
+}
+
+// InjectPacket queues an already decoded packet for the sniffer.
+func (s *InjectedSource) InjectPacket(packet gopacket.Packet) error {
+	return s.Inject(packet.Data(), packet.Metadata().CaptureInfo)
+}
+
+// Close ends the source. The packets injected before Close are still read, and then ReadPacketData
+// returns io.EOF.
+func (s *InjectedSource) Close() error {
+	s.closeOnce.Do(
+		func() {
+			close(s.done)
+		},
+	)
+
+	return nil
+}
+
+// ReadPacketData implements gopacket.PacketDataSource.
+func (s *InjectedSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	select {
+	case packet := <-s.packets:
+		return packet.data, packet.ci, nil
+	case <-s.done:
+	}
+
+	// return what is injected before close first
+	select {
+	case packet := <-s.packets:
+		return packet.data, packet.ci, nil
+	default:
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+}
+
+// LinkType implements PacketSource.
+func (s *InjectedSource) LinkType() layers.LinkType {
+	return s.linkType
+}
@@ -0,0 +1,184 @@
+package sniff
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/pkg/errors"
+)
+
+/*
+	contains the encoding of events that are spilled to disk when a handler queue overflows
+*/
+
+// spilledEvent is the gob encoded form of an event.
+type spilledEvent struct {
+	NetType, TransportType int64
+	NetSrc, NetDst         []byte
+	TransportSrc           []byte
+	TransportDst           []byte
+	// HTTPRequest is the request in wire format
+	HTTPRequest []byte
+	RemoteAddr  string
+	// HTTPResponse is the response in wire format, HTTPRequest is the request it answers if any.
+	HTTPResponse []byte
+	RequestTime  time.Time
+	ResponseTime time.Time
+	MQTTPacket   *MQTTPacket
+}
+
+func encodeEvent(event Event) ([]byte, error) {
+	flow := event.StreamFlow()
+	netSrc, netDst := flow.Net.Endpoints()
+	transportSrc, transportDst := flow.Transport.Endpoints()
+
+	spilled := spilledEvent{
+		NetType:       int64(flow.Net.EndpointType()),
+		TransportType: int64(flow.Transport.EndpointType()),
+		NetSrc:        netSrc.Raw(),
+		NetDst:        netDst.Raw(),
+		TransportSrc:  transportSrc.Raw(),
+		TransportDst:  transportDst.Raw(),
+	}
+
+	switch e := event.(type) {
+	case *HTTPRequestEvent:
+		raw, err := dumpRequest(e.Request)
+		if err != nil {
+			return nil, err
+		}
+
+		spilled.HTTPRequest = raw
+		spilled.RemoteAddr = e.Request.RemoteAddr
+	case *HTTPResponseEvent:
+		if e.Request != nil {
+			raw, err := dumpRequest(e.Request)
+			if err != nil {
+				return nil, err
+			}
+
+			spilled.HTTPRequest = raw
+			spilled.RemoteAddr = e.Request.RemoteAddr
+		}
+
+		raw, err := dumpResponse(e.Response)
+		if err != nil {
+			return nil, err
+		}
+
+		spilled.HTTPResponse = raw
+		spilled.RequestTime = e.RequestTime
+		spilled.ResponseTime = e.ResponseTime
+	case *MQTTEvent:
+		spilled.MQTTPacket = e.Packet
+	default:
+		return nil, errors.Errorf("can not spill %T events", event)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&spilled); err != nil {
+		return nil, errors.Wrap(err, "failed to encode event")
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodeEvent(raw []byte) (Event, error) {
+	var spilled spilledEvent
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&spilled); err != nil {
+		return nil, errors.Wrap(err, "failed to decode event")
+	}
+
+	flow := Flow{
+		Net: gopacket.NewFlow(
+			gopacket.EndpointType(spilled.NetType), spilled.NetSrc, spilled.NetDst,
+		),
+		Transport: gopacket.NewFlow(
+			gopacket.EndpointType(spilled.TransportType), spilled.TransportSrc, spilled.TransportDst,
+		),
+	}
+
+	if spilled.MQTTPacket != nil {
+		return &MQTTEvent{Flow: flow, Packet: spilled.MQTTPacket}, nil
+	}
+
+	var req *http.Request
+
+	if spilled.HTTPRequest != nil {
+		var err error
+
+		req, err = http.ReadRequest(bufio.NewReader(bytes.NewReader(spilled.HTTPRequest)))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode spilled request")
+		}
+
+		req.RemoteAddr = spilled.RemoteAddr
+
+		body, _ := ioutil.ReadAll(req.Body)
+		setBody(req, body)
+	}
+
+	if spilled.HTTPResponse == nil {
+		return &HTTPRequestEvent{Flow: flow, Request: req}, nil
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(spilled.HTTPResponse)), req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode spilled response")
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body = newBytesBody(body)
+
+	return &HTTPResponseEvent{
+		Flow:         flow,
+		Request:      req,
+		Response:     resp,
+		RequestTime:  spilled.RequestTime,
+		ResponseTime: spilled.ResponseTime,
+	}, nil
+}
+
+// dumpRequest writes the request in wire format without consuming its body, which other handlers may
+// still be reading.
+func dumpRequest(req *http.Request) ([]byte, error) {
+	dup, err := cloneRequest(req.Context(), req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to copy request body")
+	}
+
+	// keep Write from adding its default user agent to requests that did not have one
+	if _, ok := dup.Header["User-Agent"]; !ok {
+		dup.Header["User-Agent"] = []string{""}
+	}
+
+	var buf bytes.Buffer
+	if err := dup.Write(&buf); err != nil {
+		return nil, errors.Wrap(err, "failed to encode request")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// dumpResponse writes the response in wire format without consuming its body.
+func dumpResponse(resp *http.Response) ([]byte, error) {
+	body, ok := resp.Body.(*bytesBody)
+	if !ok {
+		return nil, errors.New("can not spill a response that is not decoded by the sniffer")
+	}
+
+	dup := *resp
+	dup.Body = ioutil.NopCloser(bytes.NewReader(body.raw))
+
+	var buf bytes.Buffer
+	if err := dup.Write(&buf); err != nil {
+		return nil, errors.Wrap(err, "failed to encode response")
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,91 @@
+package sniff
+
+import (
+	"sync/atomic"
+)
+
+/*
+	contains the counters of the sniffing pipeline, from the packet capture to the handlers
+*/
+
+// CaptureStats are the counters of the capture mechanism under a packet source, such as the kernel for
+// live interfaces.
+type CaptureStats struct {
+	// Received is the number of packets the capture mechanism received.
+	Received uint64
+	// Dropped is the number of packets dropped because the sniffer did not read them fast enough.
+	Dropped uint64
+	// InterfaceDropped is the number of packets dropped by the network interface or its driver.
+	InterfaceDropped uint64
+}
+
+// StatsSource is a packet source that reports the counters of its capture mechanism. Live interfaces
+// opened by the sniffer implement it.
+type StatsSource interface {
+	PacketSource
+	CaptureStats() (CaptureStats, error)
+}
+
+// Stats are the counters of a sniffer.
+type Stats struct {
+	// Capture is zero when the packet source does not report capture counters.
+	Capture CaptureStats
+	// PacketsDecoded is the number of tcp packets handed to the tcp reassembly.
+	PacketsDecoded uint64
+	// PacketsNonTCP is the number of packets skipped because they do not carry tcp, and PacketsInvalid is
+	// the number of packets skipped because they could not be decoded.
+	PacketsNonTCP  uint64
+	PacketsInvalid uint64
+	// ActiveStreams is the number of tcp streams being decoded.
+	ActiveStreams int64
+	// FlushedStreams is the number of streams closed because they were idle, or the source ended.
+	FlushedStreams uint64
+	// HTTPParseErrors and MQTTParseErrors are the number of times a stream had data that could not be
+	// decoded.
+	HTTPParseErrors uint64
+	MQTTParseErrors uint64
+	// RequestsEmitted and ResponsesEmitted are the numbers of decoded http requests and responses, and
+	// EventsEmitted is the number of every decoded event, including the http ones.
+	RequestsEmitted  uint64
+	ResponsesEmitted uint64
+	EventsEmitted    uint64
+	// Errors is the number of error events, from streams, handlers and ReportError, and Panics is the
+	// number of them that are recovered from a panic.
+	Errors uint64
+	Panics uint64
+	// Handlers are the counters of the handlers, in the order they are added.
+	Handlers []HandlerStats
+}
+
+// pipelineStats are the counters shared by the packet reading loop and the streams.
+type pipelineStats struct {
+	packetsDecoded   uint64
+	packetsNonTCP    uint64
+	packetsInvalid   uint64
+	activeStreams    int64
+	flushedStreams   uint64
+	httpParseErrors  uint64
+	mqttParseErrors  uint64
+	requestsEmitted  uint64
+	responsesEmitted uint64
+	eventsEmitted    uint64
+	errors           uint64
+	panics           uint64
+}
+
+func (p *pipelineStats) load() Stats {
+	return Stats{
+		PacketsDecoded:   atomic.LoadUint64(&p.packetsDecoded),
+		PacketsNonTCP:    atomic.LoadUint64(&p.packetsNonTCP),
+		PacketsInvalid:   atomic.LoadUint64(&p.packetsInvalid),
+		ActiveStreams:    atomic.LoadInt64(&p.activeStreams),
+		FlushedStreams:   atomic.LoadUint64(&p.flushedStreams),
+		HTTPParseErrors:  atomic.LoadUint64(&p.httpParseErrors),
+		MQTTParseErrors:  atomic.LoadUint64(&p.mqttParseErrors),
+		RequestsEmitted:  atomic.LoadUint64(&p.requestsEmitted),
+		ResponsesEmitted: atomic.LoadUint64(&p.responsesEmitted),
+		EventsEmitted:    atomic.LoadUint64(&p.eventsEmitted),
+		Errors:           atomic.LoadUint64(&p.errors),
+		Panics:           atomic.LoadUint64(&p.panics),
+	}
+}
@@ -0,0 +1,208 @@
+package sniff
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	"github.com/google/gopacket/tcpassembly/tcpreader"
+)
+
+/*
+	contains the stream factory, which hands the reassembled tcp streams to the http and mqtt decoders
+*/
+
+// streamFactory implements tcpassembly.StreamFactory. It picks the application layer decoder of every
+// new stream by looking at its ports.
+type streamFactory struct {
+	// This part is what we get from config
+	eventChan chan Event
+	mqttPorts map[uint16]bool
+	stats     *pipelineStats
+	// report passes the failures of the streams to the error handler of the sniffer.
+	report func(event *ErrorEvent)
+
+	// conns keeps the state shared by both directions of connections.
+	conns   map[connKey]*connState
+	connsMu sync.Mutex
+
+	// streams tracks the running stream goroutines.
+	streams sync.WaitGroup
+}
+
+func newStreamFactory(
+	cfg Cfg, eventChan chan Event, stats *pipelineStats, report func(event *ErrorEvent),
+) *streamFactory {
+	f := &streamFactory{
+		eventChan: eventChan,
+		stats:     stats,
+		report:    report,
+		mqttPorts: make(map[uint16]bool, len(cfg.MQTTPorts)),
+		conns:     make(map[connKey]*connState),
+	}
+
+	for _, port := range cfg.MQTTPorts {
+		f.mqttPorts[uint16(port)] = true
+	}
+
+	return f
+}
+
+func (h *streamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
+	if h.isMQTT(transport) {
+		return h.newMQTTStream(net, transport)
+	}
+
+	conn, release := h.openConn(net, transport)
+
+	httpStream := &httpStream{
+		net:       net,
+		transport: transport,
+		r:         timedStream{ReaderStream: tcpreader.NewReaderStream()},
+		conn:      &conn.http,
+		eventChan: h.eventChan,
+		stats:     h.stats,
+		report:    h.report,
+	}
+
+	h.startStream()
+
+	// Important... we must guarantee that data from the reader stream is read.
+	go func() {
+		defer h.endStream()
+		defer release()
+
+		httpStream.run()
+	}()
+
+	// ReaderStream implements tcpassembly.Stream, so we can return a pointer to it.
+	return &httpStream.r
+}
+
+func (h *streamFactory) isMQTT(transport gopacket.Flow) bool {
+	src, dst := transport.Endpoints()
+
+	return h.mqttPorts[portOf(src)] || h.mqttPorts[portOf(dst)]
+}
+
+func (h *streamFactory) newMQTTStream(net, transport gopacket.Flow) tcpassembly.Stream {
+	conn, release := h.openConn(net, transport)
+
+	mqttStream := &mqttStream{
+		net:       net,
+		transport: transport,
+		r:         tcpreader.NewReaderStream(),
+		conn:      &conn.mqtt,
+		eventChan: h.eventChan,
+		stats:     h.stats,
+		report:    h.report,
+		done:      release,
+	}
+
+	h.startStream()
+
+	go func() {
+		defer h.endStream()
+
+		mqttStream.run()
+	}()
+
+	return &mqttStream.r
+}
+
+// openConn returns the state of the connection of a new stream. The returned function releases it when
+// the stream ends, and the state is forgotten once both directions are released.
+func (h *streamFactory) openConn(net, transport gopacket.Flow) (*connState, func()) {
+	key := newConnKey(net, transport)
+
+	h.connsMu.Lock()
+	defer h.connsMu.Unlock()
+
+	conn, ok := h.conns[key]
+	if !ok {
+		conn = newConnState()
+		h.conns[key] = conn
+	}
+
+	conn.streams++
+
+	return conn, func() {
+		h.connsMu.Lock()
+		defer h.connsMu.Unlock()
+
+		conn.streams--
+		if conn.streams == 0 {
+			delete(h.conns, key)
+		}
+	}
+}
+
+func (h *streamFactory) startStream() {
+	h.streams.Add(1)
+	atomic.AddInt64(&h.stats.activeStreams, 1)
+}
+
+func (h *streamFactory) endStream() {
+	atomic.AddInt64(&h.stats.activeStreams, -1)
+	h.streams.Done()
+}
+
+// wait waits until every stream goroutine returns. It returns false if ctx is done first.
+func (h *streamFactory) wait(ctx context.Context) bool {
+	done := make(chan struct{})
+
+	go func() {
+		h.streams.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-done:
+		return true
+	}
+}
+
+// connState is shared by both directions of a tcp connection.
+type connState struct {
+	// streams is the number of running streams of the connection, guarded by the factory.
+	streams int
+	mqtt    mqttConn
+	http    httpConn
+}
+
+func newConnState() *connState {
+	return &connState{}
+}
+
+// connKey identifies a tcp connection regardless of the direction of the stream.
+type connKey struct {
+	net, transport gopacket.Flow
+}
+
+func newConnKey(net, transport gopacket.Flow) connKey {
+	src, dst := net.Endpoints()
+	srcPort, dstPort := transport.Endpoints()
+
+	// both directions should produce the same key, so always keep the smaller endpoint as the source.
+	if cmp := bytes.Compare(src.Raw(), dst.Raw()); cmp > 0 ||
+		cmp == 0 && bytes.Compare(srcPort.Raw(), dstPort.Raw()) > 0 {
+		return connKey{net: net.Reverse(), transport: transport.Reverse()}
+	}
+
+	return connKey{net: net, transport: transport}
+}
+
+func portOf(endpoint gopacket.Endpoint) uint16 {
+	raw := endpoint.Raw()
+	if len(raw) != 2 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint16(raw)
+}
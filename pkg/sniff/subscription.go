@@ -0,0 +1,120 @@
+package sniff
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	contains the channel based alternative to handlers
+*/
+
+// Subscription receives the decoded events on a channel, until it is unsubscribed or the sniffer stops.
+type Subscription struct {
+	// C receives the events that pass the filter of the subscription. It is closed when the subscription
+	// ends.
+	C <-chan Event
+
+	events  chan Event
+	filter  func(event Event) bool
+	dropped uint64
+	set     *subscriptions
+	once    sync.Once
+}
+
+// Unsubscribe stops the delivery of events and closes C. It is safe to call more than once.
+func (s *Subscription) Unsubscribe() {
+	s.set.remove(s)
+}
+
+// Dropped returns the number of events dropped because the buffer of the subscription was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Subscription) close() {
+	s.once.Do(
+		func() {
+			close(s.events)
+		},
+	)
+}
+
+// subscriptions is the set of active subscriptions of a sniffer.
+type subscriptions struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+	// closed is true once the sniffer stops, new subscriptions are closed right away.
+	closed bool
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{subs: make(map[*Subscription]struct{})}
+}
+
+func (s *subscriptions) add(bufferSize int, filter func(event Event) bool) *Subscription {
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+
+	events := make(chan Event, bufferSize)
+	sub := &Subscription{
+		C:      events,
+		events: events,
+		filter: filter,
+		set:    s,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		sub.close()
+
+		return sub
+	}
+
+	s.subs[sub] = struct{}{}
+
+	return sub
+}
+
+func (s *subscriptions) remove(sub *Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.subs, sub)
+	sub.close()
+}
+
+// publish hands the event to every subscription whose filter it passes. Subscriptions never hold back
+// the sniffer, the event is dropped for subscribers with a full buffer.
+func (s *subscriptions) publish(event Event) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for sub := range s.subs {
+		if sub.filter != nil && !sub.filter(event) {
+			continue
+		}
+
+		select {
+		case sub.events <- event:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// closeAll ends every subscription, when the sniffer stops.
+func (s *subscriptions) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	for sub := range s.subs {
+		delete(s.subs, sub)
+		sub.close()
+	}
+}
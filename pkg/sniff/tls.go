@@ -0,0 +1,81 @@
+package sniff
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	contains the tls configuration of the connections to https targets
+*/
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSCfg configures how https targets are connected to.
+type TLSCfg struct {
+	// CAFile is a pem bundle of the certificate authorities that targets are verified with, instead of the
+	// ones of the system.
+	CAFile string `json:"ca_file" mapstructure:"CA_FILE"`
+	// CertFile and KeyFile are the pem client certificate and key sent to targets that ask for one.
+	CertFile string `json:"cert_file" mapstructure:"CERT_FILE"`
+	KeyFile  string `json:"key_file" mapstructure:"KEY_FILE"`
+	// ServerName is sent as the server name indication and verified against the certificate of the target,
+	// instead of the host of the target.
+	ServerName string `json:"server_name" mapstructure:"SERVER_NAME"`
+	// MinVersion is the lowest tls version used, 1.0, 1.1, 1.2 or 1.3. (default: the one of the go version)
+	MinVersion string `json:"min_version" mapstructure:"MIN_VERSION"`
+	// InsecureSkipVerify accepts any certificate of the target. It is meant for tests only.
+	InsecureSkipVerify bool `json:"insecure_skip_verify" mapstructure:"INSECURE_SKIP_VERIFY"`
+}
+
+// Config reads the files of the configuration, and returns the tls configuration of a client.
+func (c TLSCfg) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify, // nolint:gosec // only when it is asked for explicitly
+	}
+
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, errors.Errorf("invalid tls version %q, expected 1.0, 1.1, 1.2 or 1.3", c.MinVersion)
+		}
+
+		config.MinVersion = version
+	}
+
+	if c.CAFile != "" {
+		raw, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read ca bundle")
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(raw) {
+			return nil, errors.Errorf("ca bundle %s has no pem certificates", c.CAFile)
+		}
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("client certificate needs both a cert file and a key file")
+	}
+
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client certificate")
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}